@@ -13,7 +13,8 @@ type ResponseWrapper struct {
 
 	request *http.Request
 	feeder  *UmamiFeeder
-	written bool // Track if WriteHeader was called
+	options *trackOptions // Tracking options resolved for the request host
+	written bool          // Track if WriteHeader was called
 }
 
 // WriteHeader intercepts the status code and submits the request to the Umami feeder if needed.
@@ -24,8 +25,8 @@ func (rw *ResponseWrapper) WriteHeader(statusCode int) {
 	}
 	rw.written = true
 
-	if rw.feeder.shouldTrackStatus(statusCode) {
-		rw.feeder.submitToFeed(rw.request, statusCode)
+	if rw.feeder.shouldTrackStatus(statusCode, rw.options) {
+		rw.feeder.submitToFeed(rw.request, statusCode, rw.options)
 	}
 
 	// Continue with the original method.
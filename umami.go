@@ -5,15 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"math"
 	"net/http"
 	"net/netip"
 	"os"
 	"path"
-	"regexp"
 	"slices"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,27 +25,132 @@ type Config struct {
 	Debug bool `json:"debug"`
 	// QueueSize defines the size of queue, i.e. the amount of events that are waiting to be submitted to Umami.
 	QueueSize int `json:"queueSize"`
+	// QueueOverflowPolicy defines what happens to events when the queue is full, one of
+	// "drop-newest" (default), "drop-oldest", "block" or "sample".
+	QueueOverflowPolicy string `json:"queueOverflowPolicy"`
+	// QueueBlockTimeout defines how long the "block" policy waits for room in the queue.
+	QueueBlockTimeout time.Duration `json:"queueBlockTimeout"`
+	// QueueSampleHighWater defines the queue fill level in percent above which the "sample" policy starts to drop events.
+	QueueSampleHighWater int `json:"queueSampleHighWater"`
+	// QueueSampleRatio defines the fraction of events kept by the "sample" policy above the high-water mark.
+	QueueSampleRatio float64 `json:"queueSampleRatio"`
 	// BatchSize defines the amount of events that are submitted to Umami in one request.
 	BatchSize int `json:"batchSize"`
 	// BatchMaxWait defines the maximum time to wait before submitting the batch.
 	BatchMaxWait time.Duration `json:"batchMaxWait"`
+	// BatchMaxSize defines up to how many events the batch size grows while the queue is deep and Umami responds fast.
+	BatchMaxSize int `json:"batchMaxSize"`
+	// BatchMaxBytes caps the serialized size of a batch, 0 disables the limit.
+	BatchMaxBytes int `json:"batchMaxBytes"`
+	// BatchTargetLatency defines the response time of Umami below which the batch size grows, and above which it shrinks.
+	BatchTargetLatency time.Duration `json:"batchTargetLatency"`
+	// Workers defines how many workers send batches to Umami concurrently, each with its own batch and timer.
+	Workers int `json:"workers"`
+	// MaxWorkers enables adaptive scaling: while the queue stays above WorkersHighWater, workers are added up to MaxWorkers.
+	// Added workers stop again when they are idle.
+	MaxWorkers int `json:"maxWorkers"`
+	// WorkersHighWater defines the queue fill level (percent) above which workers are added.
+	WorkersHighWater int `json:"workersHighWater"`
+	// RetryMaxAttempts defines how many times a failed batch is retried before it is dropped.
+	RetryMaxAttempts int `json:"retryMaxAttempts"`
+	// RetryInitialInterval defines the delay before the first retry, it is doubled on every subsequent attempt.
+	RetryInitialInterval time.Duration `json:"retryInitialInterval"`
+	// RetryMaxInterval caps the delay between two retries.
+	RetryMaxInterval time.Duration `json:"retryMaxInterval"`
+	// RetryMaxAge defines how long a failed batch is retried at most, counted from the first attempt.
+	RetryMaxAge time.Duration `json:"retryMaxAge"`
+	// ShutdownTimeout defines how long the queued events are still delivered to Umami when the worker is stopped.
+	ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+	// CircuitBreakerThreshold defines after how many consecutive failed calls to Umami the circuit breaker opens,
+	// 0 disables it. While open, calls fail at once and batches are spooled or dropped.
+	CircuitBreakerThreshold int `json:"circuitBreakerThreshold"`
+	// CircuitBreakerOpenTimeout defines how long the circuit breaker stays open before a probe call is let through.
+	CircuitBreakerOpenTimeout time.Duration `json:"circuitBreakerOpenTimeout"`
+
+	// SpoolDir enables a disk-backed spool in the given directory, used when delivery fails or the queue is full.
+	SpoolDir string `json:"spoolDir"`
+	// SpoolMaxBytes defines the maximum size of the spool, the oldest events are discarded when it is exceeded.
+	SpoolMaxBytes int64 `json:"spoolMaxBytes"`
+	// SpoolMaxAge defines how old a spooled event may be to be still sent to Umami.
+	SpoolMaxAge time.Duration `json:"spoolMaxAge"`
 
 	// UmamiHost is the URL of the Umami instance.
 	UmamiHost string `json:"umamiHost"`
+	// UmamiHosts are URLs of further Umami instances sharing the database of UmamiHost, used for failover.
+	UmamiHosts []string `json:"umamiHosts"`
+	// FailoverMode defines how the endpoints are used: "priority" (default) sends to the first available one,
+	// "round-robin" spreads the calls over the available ones.
+	FailoverMode string `json:"failoverMode"`
+	// HealthCheckInterval defines how often the heartbeat of every endpoint is checked when UmamiHosts is set, 0 disables it.
+	HealthCheckInterval time.Duration `json:"healthCheckInterval"`
 	// UmamiToken is an API KEY, which is optional, but either UmamiToken or Websites should be set.
 	UmamiToken string `json:"umamiToken"`
+	// UmamiTokenFile is a path to a file containing the UmamiToken, it is re-read on every reconnect.
+	UmamiTokenFile string `json:"umamiTokenFile"`
 	// UmamiUsername could be provided as an alternative to UmamiToken, used to retrieve the token.
 	UmamiUsername string `json:"umamiUsername"`
 	// UmamiPassword is required if UmamiUsername is set.
 	UmamiPassword string `json:"umamiPassword"`
+	// UmamiPasswordFile is a path to a file containing the UmamiPassword, it is re-read on every login.
+	UmamiPasswordFile string `json:"umamiPasswordFile"`
 	// UmamiTeamId defines a team, which will be used to retrieve the websites.
 	UmamiTeamId string `json:"umamiTeamId"`
+	// TokenVerifyInterval defines how often the token retrieved with UmamiUsername is verified, 0 disables it.
+	TokenVerifyInterval time.Duration `json:"tokenVerifyInterval"`
+
+	// RequestTimeout defines the timeout of a single request to Umami.
+	RequestTimeout time.Duration `json:"requestTimeout"`
+	// DialTimeout defines the timeout for establishing a connection to Umami.
+	DialTimeout time.Duration `json:"dialTimeout"`
+	// TLSHandshakeTimeout defines the timeout of the TLS handshake with Umami.
+	TLSHandshakeTimeout time.Duration `json:"tlsHandshakeTimeout"`
+	// MaxIdleConns defines how many idle (keep-alive) connections to Umami are kept open.
+	MaxIdleConns int `json:"maxIdleConns"`
+	// Compression enables gzip-compressed batches with "gzip", if a probe at startup shows that Umami accepts them.
+	Compression string `json:"compression"`
+
+	// UmamiCA is the path of a PEM bundle with the CAs trusted for the connection to Umami, it is reloaded when changed.
+	UmamiCA string `json:"umamiCA"`
+	// UmamiCAPem is an inline PEM bundle with the CAs trusted for the connection to Umami.
+	UmamiCAPem string `json:"umamiCAPem"`
+	// UmamiClientCert is the path of a PEM client certificate for mTLS, it is reloaded when changed.
+	UmamiClientCert string `json:"umamiClientCert"`
+	// UmamiClientKey is the path of the PEM private key of UmamiClientCert.
+	UmamiClientKey string `json:"umamiClientKey"`
+	// UmamiServerName overrides the server name used for SNI and certificate verification.
+	UmamiServerName string `json:"umamiServerName"`
+	// UmamiInsecureSkipVerify disables the verification of Umami's certificate, use for lab clusters only.
+	UmamiInsecureSkipVerify bool `json:"umamiInsecureSkipVerify"`
 
 	// Websites is a map of domain to websiteId, which is required if UmamiToken is not set.
 	// If both UmamiToken and Websites are set, Websites will override/extend domains retrieved from the API.
+	// Besides exact domains, keys may be wildcards (`*.example.com`) or regular expressions enclosed in slashes.
+	// Exact domains take precedence, then the longest matching wildcard, then regular expressions in lexical order.
 	Websites map[string]string `json:"websites"`
+	// Routes maps a host and path prefix to a website, so several apps on one hostname can be tracked separately.
+	// Routes take precedence over Websites, the longest matching path prefix wins.
+	Routes []Route `json:"routes"`
 	// CreateNewWebsites when set to true, the plugin will create new websites using API, UmamiToken is required.
 	CreateNewWebsites bool `json:"createNewWebsites"`
+	// CreateNewWebsitesAllow limits the hosts for which websites are created, when empty all hosts are allowed.
+	// Each entry is a hostname, a wildcard (`*.example.com`) or a regular expression enclosed in slashes.
+	CreateNewWebsitesAllow []string `json:"createNewWebsitesAllow"`
+	// CreateNewWebsitesLimit defines how many websites are created at most, 0 means no limit.
+	CreateNewWebsitesLimit int `json:"createNewWebsitesLimit"`
+	// CreateNewWebsitesName is the name template of created websites, `{{host}}` is replaced by the hostname
+	// and `{{middleware}}` by the name of the middleware, e.g. `umami@file`. The middleware name is the same for all
+	// routers using it, so it can't tell them apart.
+	CreateNewWebsitesName string `json:"createNewWebsitesName"`
+	// CreateWebsiteBackoff defines how long website creation for a host is paused after it failed,
+	// the pause is doubled on every consecutive failure.
+	CreateWebsiteBackoff time.Duration `json:"createWebsiteBackoff"`
+	// CreateWebsiteMaxBackoff caps the pause after failed website creations.
+	CreateWebsiteMaxBackoff time.Duration `json:"createWebsiteMaxBackoff"`
+	// WebsitesRefreshInterval defines how often the websites are fetched again from the API, 0 disables it.
+	WebsitesRefreshInterval time.Duration `json:"websitesRefreshInterval"`
+	// RemoveDeletedWebsites when set to true, websites deleted in Umami stop being tracked on refresh.
+	// Websites defined in Websites are always kept.
+	RemoveDeletedWebsites bool `json:"removeDeletedWebsites"`
 
 	// TrackErrors defines whether errors (status codes >= 400) should be tracked.
 	TrackErrors bool `json:"trackErrors"`
@@ -65,6 +168,11 @@ type Config struct {
 	IgnoreHosts []string `json:"ignoreHosts"`
 	// IgnoreIPs is a list of IPs or CIDRs to ignore.
 	IgnoreIPs []string `json:"ignoreIPs"`
+	// StripWWW when set to true, a leading "www." is removed from hostnames, so both forms share a website.
+	StripWWW bool `json:"stripWWW"`
+	// HostAliases maps hostnames to the canonical hostname used for the website lookup and the reported hostname.
+	// Example: {"old-brand.com": "example.com"}
+	HostAliases map[string]string `json:"hostAliases"`
 	// HeaderIp is the header name associated with the real IP address.
 	HeaderIp string `json:"headerIp"`
 
@@ -73,28 +181,84 @@ type Config struct {
 	// in the event's Data field using the mapped name.
 	// Example: {"X-Auth-Request-User": "user", "X-Auth-Request-Department": "department"}
 	CaptureHeaders map[string]string `json:"captureHeaders"`
+
+	// Hosts overrides the tracking options trackErrors, trackAllResources, trackExtensions, ignoreURLs and captureHeaders
+	// for the hosts matching its keys, which may be hostnames, wildcards or regular expressions enclosed in slashes.
+	Hosts map[string]HostConfig `json:"hosts"`
+	// SensitiveHeaders is a list of header names, whose captured values are never written to the log.
+	SensitiveHeaders []string `json:"sensitiveHeaders"`
+	// MetricsPath enables the metrics of the delivery in the Prometheus text format at the given path.
+	MetricsPath string `json:"metricsPath"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		Disabled:     false,
-		Enabled:      true,
-		Debug:        false,
-		QueueSize:    1000,
-		BatchSize:    20,
-		BatchMaxWait: 5 * time.Second,
-		TrackErrors:  false,
+		Disabled:             false,
+		Enabled:              true,
+		Debug:                false,
+		QueueSize:            1000,
+		QueueOverflowPolicy:  OverflowDropNewest,
+		QueueBlockTimeout:    100 * time.Millisecond,
+		QueueSampleHighWater: 80,
+		QueueSampleRatio:     0.5,
+		BatchSize:            20,
+		BatchMaxWait:         5 * time.Second,
+		BatchMaxSize:         100,
+		BatchMaxBytes:        512 << 10,
+		BatchTargetLatency:   time.Second,
+		Workers:              1,
+		MaxWorkers:           4,
+		WorkersHighWater:     50,
+		TrackErrors:          false,
+
+		RetryMaxAttempts:     5,
+		RetryInitialInterval: time.Second,
+		RetryMaxInterval:     time.Minute,
+		RetryMaxAge:          5 * time.Minute,
+		ShutdownTimeout:      5 * time.Second,
+
+		CircuitBreakerThreshold:   5,
+		CircuitBreakerOpenTimeout: 30 * time.Second,
+
+		SpoolDir:      "",
+		SpoolMaxBytes: 100 << 20,
+		SpoolMaxAge:   24 * time.Hour,
 
 		UmamiHost:     "",
+		UmamiHosts:    []string{},
+		FailoverMode:  FailoverPriority,
 		UmamiToken:    "",
 		UmamiUsername: "",
 		UmamiPassword: "",
-		UmamiTeamId:   "",
+
+		UmamiTokenFile:    "",
+		UmamiPasswordFile: "",
+		UmamiTeamId:       "",
+
+		TokenVerifyInterval: time.Hour,
+		HealthCheckInterval: 30 * time.Second,
+
+		RequestTimeout:      10 * time.Second,
+		DialTimeout:         5 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		Compression:         "",
 
 		Websites:          map[string]string{},
+		Routes:            []Route{},
 		CreateNewWebsites: false,
 
+		CreateNewWebsitesAllow: []string{},
+		CreateNewWebsitesLimit: 0,
+		CreateNewWebsitesName:  "{{host}}",
+
+		CreateWebsiteBackoff:    time.Minute,
+		CreateWebsiteMaxBackoff: time.Hour,
+
+		WebsitesRefreshInterval: 10 * time.Minute,
+		RemoveDeletedWebsites:   false,
+
 		TrackAllResources: false,
 		TrackExtensions:   []string{},
 
@@ -102,9 +266,14 @@ func CreateConfig() *Config {
 		IgnoreURLs:       []string{},
 		IgnoreHosts:      []string{},
 		IgnoreIPs:        []string{},
+		StripWWW:         false,
+		HostAliases:      map[string]string{},
 		HeaderIp:         "X-Real-IP",
 
-		CaptureHeaders: map[string]string{},
+		CaptureHeaders:   map[string]string{},
+		Hosts:            map[string]HostConfig{},
+		SensitiveHeaders: []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Auth-Request-Access-Token"},
+		MetricsPath:      "",
 	}
 }
 
@@ -113,19 +282,16 @@ type UmamiFeeder struct {
 	next       http.Handler
 	name       string
 	isDebug    bool
-	isEnabled  bool
+	state      atomic.Int32
 	logHandler *log.Logger
-	queue      chan *UmamiEvent
+	backend    *umamiBackend
 
-	batchSize    int
-	batchMaxWait time.Duration
-
-	umamiHost         string
-	umamiToken        string
-	umamiTeamId       string
-	websites          map[string]string
-	websitesMutex     sync.RWMutex
-	createNewWebsites bool
+	// trackingRules holds the compiled *trackingRules, it is replaced as a whole once the configuration is verified.
+	trackingRules          atomic.Value
+	websiteIndex           atomic.Value
+	createNewWebsites      bool
+	createNewWebsitesLimit int
+	createNewWebsitesName  string
 
 	trackErrors       bool
 	trackAllResources bool
@@ -133,11 +299,12 @@ type UmamiFeeder struct {
 
 	ignoreHosts      []string
 	ignoreUserAgents []string
-	ignoreRegexps    []regexp.Regexp
-	ignorePrefixes   []netip.Prefix
 	headerIp         string
+	hosts            hostCanonicalizer
 
-	captureHeaders map[string]string
+	captureHeaders   map[string]string
+	sensitiveHeaders []string
+	metricsPath      string
 }
 
 // New creates a new UmamiFeeder plugin.
@@ -146,19 +313,11 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		next:       next,
 		name:       name,
 		isDebug:    config.Debug,
-		isEnabled:  config.Enabled && !config.Disabled,
 		logHandler: log.New(os.Stdout, "", 0),
 
-		queue:        make(chan *UmamiEvent, config.QueueSize),
-		batchSize:    config.BatchSize,
-		batchMaxWait: config.BatchMaxWait,
-
-		umamiHost:         config.UmamiHost,
-		umamiToken:        config.UmamiToken,
-		umamiTeamId:       config.UmamiTeamId,
-		websites:          config.Websites,
-		websitesMutex:     sync.RWMutex{},
-		createNewWebsites: config.CreateNewWebsites,
+		createNewWebsites:      config.CreateNewWebsites,
+		createNewWebsitesLimit: config.CreateNewWebsitesLimit,
+		createNewWebsitesName:  config.CreateNewWebsitesName,
 
 		trackErrors:       config.TrackErrors,
 		trackAllResources: config.TrackAllResources,
@@ -166,48 +325,73 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 
 		ignoreHosts:      config.IgnoreHosts,
 		ignoreUserAgents: config.IgnoreUserAgents,
-		ignoreRegexps:    []regexp.Regexp{},
-		ignorePrefixes:   []netip.Prefix{},
 		headerIp:         config.HeaderIp,
+		hosts:            newHostCanonicalizer(config.StripWWW, config.HostAliases),
+
+		captureHeaders:   config.CaptureHeaders,
+		sensitiveHeaders: config.SensitiveHeaders,
+		metricsPath:      config.MetricsPath,
+	}
 
-		captureHeaders: config.CaptureHeaders,
+	if !config.Enabled || config.Disabled {
+		h.state.Store(stateDisabled)
+		return h, nil
 	}
 
-	if h.isEnabled {
-		h.isEnabled = false // Disable until connection and config verification is done.
-		go h.retryConnection(ctx, config)
+	// Requests are not tracked until connection and config verification is done.
+	h.state.Store(stateConnecting)
+	// Instances sending to the same Umami share the connection, the queue and the worker.
+	h.backend = acquireBackend(ctx, config, name)
+	go h.retryConnection(ctx, config)
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			h.stop()
+		}()
 	}
 
 	return h, nil
 }
 
 func (h *UmamiFeeder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if h.isEnabled && h.shouldTrack(req) {
-		// If the resource should be reported, we wrap the response writer and check the status code before reporting
-		responseWrapper := &ResponseWrapper{
-			ResponseWriter: rw,
-			request:        req,
-			feeder:         h,
-		}
-
-		// Continue with next handler.
-		h.next.ServeHTTP(responseWrapper, req)
+	if h.metricsPath != "" && req.URL.Path == h.metricsPath && h.backend != nil {
+		h.serveMetrics(rw)
 		return
 	}
 
+	if h.state.Load() == stateRunning {
+		hostname := h.hosts.canonical(req.Host)
+		options := h.resolveOptions(hostname)
+
+		if h.shouldTrack(req, hostname, options) {
+			// If the resource should be reported, we wrap the response writer and check the status code before reporting
+			responseWrapper := &ResponseWrapper{
+				ResponseWriter: rw,
+				request:        req,
+				feeder:         h,
+				options:        options,
+			}
+
+			// Continue with next handler.
+			h.next.ServeHTTP(responseWrapper, req)
+			return
+		}
+	}
+
 	h.next.ServeHTTP(rw, req)
 }
 
+// retryConnection waits for the connection of the backend, then verifies the configuration of the instance.
+// Checks of the instance which fail are retried with an increasing delay, the backend is not connected again.
 func (h *UmamiFeeder) retryConnection(ctx context.Context, config *Config) {
-	const maxRetryInterval = time.Hour
+	if err := h.backend.awaitConnection(ctx); err != nil {
+		h.debugf("Context canceled during retryConnection, stopping connection retries.")
+		return
+	}
+
 	retryAttempt := 0
 	for {
-		currentDelay := maxRetryInterval
-		if retryAttempt == 0 {
-			currentDelay = 0
-		} else if retryAttempt < 8 {
-			currentDelay = time.Duration(15*math.Pow(2, float64(retryAttempt))) * time.Second
-		}
+		currentDelay := connectRetryDelay(retryAttempt)
 
 		if retryAttempt > 0 { // Don't log for the immediate first attempt
 			h.debugf("Next connection attempt in %v (attempt #%d).", currentDelay, retryAttempt+1)
@@ -221,17 +405,23 @@ func (h *UmamiFeeder) retryConnection(ctx context.Context, config *Config) {
 			err := h.connect(ctx, config)
 			if err == nil {
 				h.debugf("Successfully connected to Umami. Verifying configuration...")
+				if !h.transition(stateConnecting, stateVerifying) {
+					return // Stopped while connecting.
+				}
 
-				err = h.verifyConfig(config)
+				err = h.backend.verifyConfig(config)
+				if err == nil {
+					err = h.verifyConfig(config)
+				}
 				if err == nil {
 					h.debugf("Configuration verified. Enabling plugin and starting worker.")
-					h.isEnabled = true
-					go h.startWorker(ctx)
+					h.backend.start()
+					h.transition(stateVerifying, stateRunning)
 					return // Successfully connected and configured, exit retry goroutine
 				}
 
 				h.error("Configuration error, the plugin is disabled: " + err.Error())
-				h.isEnabled = false
+				h.transition(stateVerifying, stateDisabled)
 				return // Exit retry goroutine, plugin remains disabled.
 			}
 
@@ -244,48 +434,57 @@ func (h *UmamiFeeder) retryConnection(ctx context.Context, config *Config) {
 }
 
 func (h *UmamiFeeder) connect(ctx context.Context, config *Config) error {
-	if h.umamiHost == "" {
-		return errors.New("umamiHost is not set")
+	if err := h.backend.connect(ctx); err != nil {
+		return err
 	}
-
-	if config.UmamiUsername != "" && config.UmamiPassword != "" {
-		token, err := getToken(ctx, h.umamiHost, config.UmamiUsername, config.UmamiPassword)
-		if err != nil {
-			return fmt.Errorf("failed to get token: %w", err)
-		}
-		if token == "" {
-			return errors.New("retrieved token is empty")
-		}
-		h.debugf("token received %s", token)
-		h.umamiToken = token
-	}
-	if h.umamiToken == "" && len(h.websites) == 0 {
+	if h.backend.token() == "" && len(config.Websites) == 0 && len(config.Routes) == 0 {
 		return errors.New("either umamiToken or websites must be set")
 	}
-	if h.umamiToken == "" && h.createNewWebsites {
+	if h.backend.token() == "" && h.createNewWebsites {
 		return errors.New("umamiToken is required to create new websites")
 	}
 
-	if h.umamiToken != "" {
-		websites, err := fetchWebsites(ctx, h.umamiHost, h.umamiToken, h.umamiTeamId)
+	return nil
+}
+
+// verifyConfig compiles the tracking rules and stores them, the stored rules are never modified.
+func (h *UmamiFeeder) verifyConfig(config *Config) error {
+	rules := &trackingRules{}
+
+	if len(config.Websites) > 0 {
+		websites, err := expandWebsites(config.Websites)
 		if err != nil {
-			return fmt.Errorf("failed to fetch websites: %w", err)
+			return err
 		}
-
-		h.websitesMutex.Lock()
-		for _, website := range *websites {
-			if _, ok := h.websites[website.Domain]; !ok {
-				h.websites[website.Domain] = website.ID
+		// Exact domains are looked up directly, wildcard and regexp keys are compiled to patterns.
+		rules.staticWebsites = make(map[string]string, len(websites))
+		for domain, websiteId := range websites {
+			if !isHostPatternKey(domain) {
+				rules.staticWebsites[h.hosts.canonical(domain)] = websiteId
 			}
 		}
-		h.websitesMutex.Unlock()
-		h.debugf("websites fetched: %v", h.websites)
+		rules.websitePatterns, err = compileWebsitePatterns(websites, &h.hosts)
+		if err != nil {
+			return fmt.Errorf("invalid websites: %w", err)
+		}
 	}
 
-	return nil
-}
+	if len(config.Routes) > 0 {
+		routes, err := compileRoutes(config.Routes, &h.hosts)
+		if err != nil {
+			return fmt.Errorf("invalid routes: %w", err)
+		}
+		rules.routes = routes
+	}
+
+	if len(config.CreateNewWebsitesAllow) > 0 {
+		patterns, err := compileHostPatterns(config.CreateNewWebsitesAllow, &h.hosts)
+		if err != nil {
+			return fmt.Errorf("invalid createNewWebsitesAllow: %w", err)
+		}
+		rules.createNewWebsitesAllow = patterns
+	}
 
-func (h *UmamiFeeder) verifyConfig(config *Config) error {
 	if len(config.IgnoreIPs) > 0 {
 		for _, ignoreIP := range config.IgnoreIPs {
 			network, err := netip.ParsePrefix(ignoreIP)
@@ -297,25 +496,31 @@ func (h *UmamiFeeder) verifyConfig(config *Config) error {
 				return fmt.Errorf("invalid ignoreIP given %s: %w", ignoreIP, err)
 			}
 
-			h.ignorePrefixes = append(h.ignorePrefixes, network)
+			rules.ignorePrefixes = append(rules.ignorePrefixes, network)
 		}
 	}
 
 	if len(config.IgnoreURLs) > 0 {
-		for _, location := range config.IgnoreURLs {
-			r, err := regexp.Compile(location)
-			if err != nil {
-				return fmt.Errorf("failed to compile ignoreURL %s: %w", location, err)
-			}
+		regexps, err := compileIgnoreURLs(config.IgnoreURLs)
+		if err != nil {
+			return err
+		}
+		rules.ignoreRegexps = regexps
+	}
 
-			h.ignoreRegexps = append(h.ignoreRegexps, *r)
+	if len(config.Hosts) > 0 {
+		overrides, err := compileHostOverrides(config.Hosts, &h.hosts)
+		if err != nil {
+			return fmt.Errorf("invalid hosts: %w", err)
 		}
+		rules.hostOverrides = overrides
 	}
 
+	h.trackingRules.Store(rules)
 	return nil
 }
 
-func (h *UmamiFeeder) shouldTrackRequest(req *http.Request) bool {
+func (h *UmamiFeeder) shouldTrackRequest(req *http.Request, options *trackOptions) bool {
 	if len(h.ignoreHosts) > 0 {
 		for _, disabledHost := range h.ignoreHosts {
 			if strings.EqualFold(req.Host, disabledHost) {
@@ -325,7 +530,7 @@ func (h *UmamiFeeder) shouldTrackRequest(req *http.Request) bool {
 		}
 	}
 
-	if len(h.ignorePrefixes) > 0 {
+	if ignorePrefixes := h.rules().ignorePrefixes; len(ignorePrefixes) > 0 {
 		requestIp := req.Header.Get(h.headerIp)
 		if requestIp == "" {
 			requestIp = req.RemoteAddr
@@ -337,7 +542,7 @@ func (h *UmamiFeeder) shouldTrackRequest(req *http.Request) bool {
 			return false
 		}
 
-		for _, prefix := range h.ignorePrefixes {
+		for _, prefix := range ignorePrefixes {
 			if prefix.Contains(ip) {
 				h.debugf("ignoring IP %s", ip)
 				return false
@@ -355,9 +560,9 @@ func (h *UmamiFeeder) shouldTrackRequest(req *http.Request) bool {
 		}
 	}
 
-	if len(h.ignoreRegexps) > 0 {
+	if len(options.ignoreRegexps) > 0 {
 		requestURL := req.URL.String()
-		for _, r := range h.ignoreRegexps {
+		for _, r := range options.ignoreRegexps {
 			if r.MatchString(requestURL) {
 				h.debugf("ignoring location %s", requestURL)
 				return false
@@ -368,42 +573,38 @@ func (h *UmamiFeeder) shouldTrackRequest(req *http.Request) bool {
 	return true
 }
 
-func (h *UmamiFeeder) shouldTrack(req *http.Request) bool {
-	if !h.shouldTrackRequest(req) {
+func (h *UmamiFeeder) shouldTrack(req *http.Request, hostname string, options *trackOptions) bool {
+	if !h.shouldTrackRequest(req, options) {
 		return false
 	}
 
-	if !h.shouldTrackResource(req.URL.Path) {
+	if !h.shouldTrackResource(req.URL.Path, options) {
 		h.debugf("ignoring resource %s", req.URL.Path)
 		return false
 	}
 
-	if h.createNewWebsites {
+	if _, _, ok := h.resolveWebsite(hostname, req.URL); ok {
 		return true
 	}
 
-	hostname := parseDomainFromHost(req.Host)
-	h.websitesMutex.RLock()
-	if _, ok := h.websites[hostname]; ok {
-		h.websitesMutex.RUnlock()
+	if h.createNewWebsites && h.isCreateWebsiteAllowed(hostname) {
 		return true
 	}
-	h.websitesMutex.RUnlock()
 
 	h.debugf("ignoring domain %s", hostname)
 	return false
 }
 
-func (h *UmamiFeeder) shouldTrackResource(url string) bool {
-	if h.trackAllResources {
+func (h *UmamiFeeder) shouldTrackResource(url string, options *trackOptions) bool {
+	if options.trackAllResources {
 		return true
 	}
 
 	pathExt := path.Ext(url)
 
 	// If a custom file extension list is defined, check if the resource matches it. If not, do not report.
-	if len(h.trackExtensions) > 0 {
-		return slices.Contains(h.trackExtensions, pathExt)
+	if len(options.trackExtensions) > 0 {
+		return slices.Contains(options.trackExtensions, pathExt)
 	}
 
 	// Check if the suffix is regarded to be "content".
@@ -415,9 +616,9 @@ func (h *UmamiFeeder) shouldTrackResource(url string) bool {
 	return false
 }
 
-func (h *UmamiFeeder) shouldTrackStatus(statusCode int) bool {
+func (h *UmamiFeeder) shouldTrackStatus(statusCode int, options *trackOptions) bool {
 	if statusCode >= 400 {
-		if h.trackErrors {
+		if options.trackErrors {
 			return true
 		}
 
@@ -430,7 +631,7 @@ func (h *UmamiFeeder) shouldTrackStatus(statusCode int) bool {
 func (h *UmamiFeeder) error(message string) {
 	if h.logHandler != nil {
 		now := time.Now().Format("2006-01-02T15:04:05Z")
-		h.logHandler.Printf("%s ERR middlewareName=%s error=\"%s\"", now, h.name, message)
+		h.logHandler.Printf("%s ERR middlewareName=%s error=\"%s\"", now, h.name, h.redact(message))
 	}
 }
 
@@ -438,6 +639,6 @@ func (h *UmamiFeeder) error(message string) {
 func (h *UmamiFeeder) debugf(format string, v ...any) {
 	if h.logHandler != nil && h.isDebug {
 		now := time.Now().Format("2006-01-02T15:04:05Z")
-		h.logHandler.Printf("%s DBG middlewareName=%s msg=\"%s\"", now, h.name, fmt.Sprintf(format, v...))
+		h.logHandler.Printf("%s DBG middlewareName=%s msg=\"%s\"", now, h.name, h.redact(fmt.Sprintf(format, v...)))
 	}
 }
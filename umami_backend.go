@@ -0,0 +1,423 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// umamiBackend holds the state shared by all middleware instances sending to the same Umami:
+// the HTTP client, the token, the websites known to Umami, the queue and the worker delivering it.
+// The tracking rules are applied by each instance.
+type umamiBackend struct {
+	key        string
+	name       string
+	isDebug    atomic.Bool
+	logHandler *log.Logger
+
+	// refs counts the instances using the backend, it is guarded by backendsMutex.
+	refs   int
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	setupMutex sync.Mutex
+	connected  bool
+	verified   bool
+	started    bool
+	// connectDone is closed once the connection attempts of the backend succeeded, nil until they are started.
+	connectDone chan struct{}
+
+	queue                chan *UmamiEvent
+	queueOverflowPolicy  string
+	queueBlockTimeout    time.Duration
+	queueSampleHighWater int
+	queueSampleRatio     float64
+	sampleCounter        atomic.Int64
+	droppedEvents        atomic.Int64
+	drops                dropSummary
+
+	batchSize          int
+	batchMaxWait       time.Duration
+	batchMaxSize       int
+	batchMaxBytes      int
+	batchTargetLatency time.Duration
+	// batchLimit is the current batch size, adapted to the latency of Umami, maxSafeBatch is the size
+	// below the smallest batch rejected as too large, 0 while none was rejected.
+	batchLimit       atomic.Int64
+	maxSafeBatch     atomic.Int64
+	workers          int
+	maxWorkers       int
+	workersHighWater int
+
+	retryMaxAttempts     int
+	retryInitialInterval time.Duration
+	retryMaxInterval     time.Duration
+	retryMaxAge          time.Duration
+	shutdownTimeout      time.Duration
+	lostBatches          atomic.Int64
+	lostEvents           atomic.Int64
+	spool                *eventSpool
+	spoolDraining        atomic.Bool
+
+	// endpoints holds umamiHost followed by umamiHosts.
+	endpoints           []*umamiEndpoint
+	failoverMode        string
+	nextEndpoint        atomic.Int64
+	healthCheckInterval time.Duration
+	compression         string
+	gzipEnabled         atomic.Bool
+	umamiToken          string
+	umamiTokenValue     string
+	umamiTokenFile      string
+	umamiUsername       string
+	umamiPassword       string
+	umamiPasswordValue  string
+	umamiPasswordFile   string
+	umamiTeamId         string
+	tokenMutex          sync.RWMutex
+	loginMutex          sync.Mutex
+	tokenVerifyInterval time.Duration
+
+	// websites holds the fetched and created websites by normalized domain,
+	// websitesVersion is incremented on every change, so instances can rebuild their index.
+	websites                map[string]string
+	websitesVersion         atomic.Int64
+	websitesMutex           sync.RWMutex
+	websitesRefreshInterval time.Duration
+	removeDeletedWebsites   bool
+	pendingWebsites         map[string]*pendingWebsite
+	pendingMutex            sync.Mutex
+	failedWebsites          map[string]*websiteFailure
+	createWebsiteBackoff    time.Duration
+	createWebsiteMaxBackoff time.Duration
+}
+
+var (
+	// backends holds the backends in use by their backendKey.
+	backends      = map[string]*umamiBackend{}
+	backendsMutex sync.Mutex
+)
+
+// backendKey identifies the backend of a configuration. Instances share a backend when they use the same Umami,
+// the same credentials and the same delivery settings, so no instance silently runs with the settings of another.
+func backendKey(config *Config) string {
+	shared := *config
+
+	// Tracking rules are applied by each instance and don't prevent sharing.
+	shared.Enabled, shared.Disabled, shared.Debug = false, false, false
+	shared.Websites, shared.Routes = nil, nil
+	shared.CreateNewWebsites, shared.CreateNewWebsitesAllow = false, nil
+	shared.CreateNewWebsitesLimit, shared.CreateNewWebsitesName = 0, ""
+	shared.TrackErrors, shared.TrackAllResources, shared.TrackExtensions = false, false, nil
+	shared.IgnoreUserAgents, shared.IgnoreURLs, shared.IgnoreHosts, shared.IgnoreIPs = nil, nil, nil, nil
+	shared.StripWWW, shared.HostAliases, shared.HeaderIp = false, nil, ""
+	shared.CaptureHeaders, shared.Hosts, shared.SensitiveHeaders = nil, nil, nil
+	shared.MetricsPath = ""
+
+	// The key contains the credentials, it is hashed so they are not kept in another form.
+	content, _ := json.Marshal(shared)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// acquireBackend returns the backend of the configuration, it is created by the first instance using it.
+// The backend is released when ctx is done and stopped once the last instance released it.
+func acquireBackend(ctx context.Context, config *Config, name string) *umamiBackend {
+	key := backendKey(config)
+
+	backendsMutex.Lock()
+	b, ok := backends[key]
+	if !ok {
+		b = newUmamiBackend(config, name)
+		b.key = key
+		backends[key] = b
+	}
+	b.refs++
+	refs := b.refs
+	backendsMutex.Unlock()
+
+	if config.Debug {
+		b.isDebug.Store(true)
+	}
+	if ok {
+		b.debugf("middleware %s shares the connection to Umami, used by %d instances", name, refs)
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			b.release()
+		}()
+	}
+	return b
+}
+
+// release removes an instance from the backend, the backend is stopped when it was the last one.
+func (b *umamiBackend) release() {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	b.refs--
+	if b.refs > 0 {
+		return
+	}
+
+	if backends[b.key] == b {
+		delete(backends, b.key)
+	}
+	b.cancel()
+}
+
+func newUmamiBackend(config *Config, name string) *umamiBackend {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	queueOverflowPolicy := config.QueueOverflowPolicy
+	if queueOverflowPolicy == "" {
+		queueOverflowPolicy = OverflowDropNewest
+	}
+	failoverMode := config.FailoverMode
+	if failoverMode == "" {
+		failoverMode = FailoverPriority
+	}
+
+	b := &umamiBackend{
+		name:       name,
+		logHandler: log.New(os.Stdout, "", 0),
+		ctx:        ctx,
+		cancel:     cancel,
+
+		queue:                make(chan *UmamiEvent, config.QueueSize),
+		queueOverflowPolicy:  queueOverflowPolicy,
+		queueBlockTimeout:    config.QueueBlockTimeout,
+		queueSampleHighWater: config.QueueSize * config.QueueSampleHighWater / 100,
+		queueSampleRatio:     config.QueueSampleRatio,
+
+		batchSize:          config.BatchSize,
+		batchMaxWait:       config.BatchMaxWait,
+		batchMaxSize:       config.BatchMaxSize,
+		batchMaxBytes:      config.BatchMaxBytes,
+		batchTargetLatency: config.BatchTargetLatency,
+		workers:            config.Workers,
+		maxWorkers:         config.MaxWorkers,
+		workersHighWater:   config.QueueSize * config.WorkersHighWater / 100,
+
+		retryMaxAttempts:     config.RetryMaxAttempts,
+		retryInitialInterval: config.RetryInitialInterval,
+		retryMaxInterval:     config.RetryMaxInterval,
+		retryMaxAge:          config.RetryMaxAge,
+		shutdownTimeout:      config.ShutdownTimeout,
+
+		failoverMode:        failoverMode,
+		healthCheckInterval: config.HealthCheckInterval,
+		compression:         config.Compression,
+		umamiTokenValue:     config.UmamiToken,
+		umamiTokenFile:      config.UmamiTokenFile,
+		umamiUsername:       config.UmamiUsername,
+		umamiPasswordValue:  config.UmamiPassword,
+		umamiPasswordFile:   config.UmamiPasswordFile,
+		umamiTeamId:         config.UmamiTeamId,
+		tokenVerifyInterval: config.TokenVerifyInterval,
+
+		websites:                map[string]string{},
+		websitesRefreshInterval: config.WebsitesRefreshInterval,
+		removeDeletedWebsites:   config.RemoveDeletedWebsites,
+		pendingWebsites:         map[string]*pendingWebsite{},
+		failedWebsites:          map[string]*websiteFailure{},
+		createWebsiteBackoff:    config.CreateWebsiteBackoff,
+		createWebsiteMaxBackoff: config.CreateWebsiteMaxBackoff,
+	}
+	b.batchLimit.Store(int64(config.BatchSize))
+
+	for _, umamiHost := range append([]string{config.UmamiHost}, config.UmamiHosts...) {
+		if umamiHost != "" {
+			b.endpoints = append(b.endpoints, b.newEndpoint(config, umamiHost))
+		}
+	}
+	return b
+}
+
+// connect retrieves the token and fetches the websites, once for all instances sharing the backend.
+func (b *umamiBackend) connect(ctx context.Context) error {
+	b.setupMutex.Lock()
+	defer b.setupMutex.Unlock()
+
+	if b.connected {
+		return nil
+	}
+	if len(b.endpoints) == 0 {
+		return errors.New("umamiHost is not set")
+	}
+
+	// Secrets are resolved on every connect, so rotated files and environment variables take effect.
+	if err := b.loadToken(); err != nil {
+		return err
+	}
+	if b.canLogin() {
+		token, err := b.login(ctx)
+		if err != nil {
+			return err
+		}
+		b.debugf("token received (%d bytes)", len(token))
+	}
+	if b.token() != "" {
+		if err := b.refreshWebsites(ctx); err != nil {
+			return err
+		}
+	}
+	if b.compression == CompressionGzip {
+		b.probeCompression(ctx)
+	}
+
+	b.connected = true
+	return nil
+}
+
+// awaitConnection waits until the backend is connected. The connection is retried by a single loop of the backend,
+// started by the first instance, so instances sharing it don't each log in while Umami is unavailable.
+func (b *umamiBackend) awaitConnection(ctx context.Context) error {
+	b.setupMutex.Lock()
+	if b.connectDone == nil {
+		b.connectDone = make(chan struct{})
+		go b.retryConnection(b.ctx)
+	}
+	done := b.connectDone
+	b.setupMutex.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryConnection connects the backend, retrying with an increasing delay until it succeeds or ctx is done.
+func (b *umamiBackend) retryConnection(ctx context.Context) {
+	for attempt := 0; ; attempt++ {
+		delay := connectRetryDelay(attempt)
+		if attempt > 0 { // Don't log for the immediate first attempt
+			b.debugf("Next connection attempt in %v (attempt #%d).", delay, attempt+1)
+		}
+
+		select {
+		case <-time.After(delay):
+			b.debugf("Attempting to connect to Umami (attempt #%d)", attempt+1)
+			if err := b.connect(ctx); err != nil {
+				b.error("Failed to reconnect to Umami: " + err.Error())
+				continue
+			}
+			close(b.connectDone)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// connectRetryDelay returns the delay before a connection attempt, the first one is made at once.
+func connectRetryDelay(attempt int) time.Duration {
+	const maxRetryInterval = time.Hour
+	switch {
+	case attempt == 0:
+		return 0
+	case attempt < 8:
+		return time.Duration(15*math.Pow(2, float64(attempt))) * time.Second
+	}
+	return maxRetryInterval
+}
+
+// verifyConfig verifies the delivery settings and opens the spool, once for all instances sharing the backend.
+func (b *umamiBackend) verifyConfig(config *Config) error {
+	b.setupMutex.Lock()
+	defer b.setupMutex.Unlock()
+
+	if b.verified {
+		return nil
+	}
+
+	if !isValidOverflowPolicy(b.queueOverflowPolicy) {
+		return fmt.Errorf("invalid queueOverflowPolicy %s", b.queueOverflowPolicy)
+	}
+	if b.queueOverflowPolicy == OverflowSample && (config.QueueSampleRatio < 0 || config.QueueSampleRatio > 1) {
+		return fmt.Errorf("invalid queueSampleRatio %v, must be between 0 and 1", config.QueueSampleRatio)
+	}
+
+	if !isValidFailoverMode(b.failoverMode) {
+		return fmt.Errorf("invalid failoverMode %s, must be %s or %s", b.failoverMode, FailoverPriority, FailoverRoundRobin)
+	}
+	if b.compression != "" && b.compression != CompressionGzip {
+		return fmt.Errorf("invalid compression %s, must be %s or empty", b.compression, CompressionGzip)
+	}
+
+	if config.BatchSize < 1 {
+		return fmt.Errorf("invalid batchSize %d, must be at least 1", config.BatchSize)
+	}
+	if config.BatchMaxBytes < 0 {
+		return fmt.Errorf("invalid batchMaxBytes %d, must not be negative", config.BatchMaxBytes)
+	}
+
+	if config.Workers < 1 {
+		return fmt.Errorf("invalid workers %d, must be at least 1", config.Workers)
+	}
+	if config.MaxWorkers > config.Workers && (config.WorkersHighWater < 1 || config.WorkersHighWater > 100) {
+		return fmt.Errorf("invalid workersHighWater %d, must be between 1 and 100", config.WorkersHighWater)
+	}
+
+	if config.SpoolDir != "" {
+		spool, err := newEventSpool(config.SpoolDir, config.SpoolMaxBytes, config.SpoolMaxAge)
+		if err != nil {
+			return err
+		}
+		b.spool = spool
+	}
+
+	b.verified = true
+	return nil
+}
+
+// start starts the workers and the background jobs, once for all instances sharing the backend.
+// They run until the last instance released the backend.
+func (b *umamiBackend) start() {
+	b.setupMutex.Lock()
+	defer b.setupMutex.Unlock()
+
+	if b.started {
+		return
+	}
+	b.started = true
+
+	go b.startWorkers(b.ctx, &workerPool{scaleInterval: workerScaleInterval, idleTimeout: workerIdleTimeout})
+	if b.canLogin() && b.tokenVerifyInterval > 0 {
+		go b.startTokenVerifier(b.ctx)
+	}
+	if b.token() != "" && b.websitesRefreshInterval > 0 {
+		go b.startWebsitesRefresher(b.ctx)
+	}
+	if len(b.endpoints) > 1 && b.healthCheckInterval > 0 {
+		go b.startHealthChecker(b.ctx)
+	}
+}
+
+func (b *umamiBackend) error(message string) {
+	if b.logHandler != nil {
+		now := time.Now().Format("2006-01-02T15:04:05Z")
+		b.logHandler.Printf("%s ERR middlewareName=%s error=\"%s\"", now, b.name, b.redact(message))
+	}
+}
+
+// Arguments are handled in the manner of [fmt.Printf].
+func (b *umamiBackend) debugf(format string, v ...any) {
+	if b.logHandler != nil && b.isDebug.Load() {
+		now := time.Now().Format("2006-01-02T15:04:05Z")
+		b.logHandler.Printf("%s DBG middlewareName=%s msg=\"%s\"", now, b.name, b.redact(fmt.Sprintf(format, v...)))
+	}
+}
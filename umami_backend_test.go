@@ -0,0 +1,138 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcquireBackend(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.UmamiHost = "http://umami.test"
+	cfg.UmamiToken = "token"
+
+	other := CreateConfig()
+	other.UmamiHost = cfg.UmamiHost
+	other.UmamiToken = cfg.UmamiToken
+	other.TrackErrors = true
+	other.Websites = map[string]string{"example.com": "1"}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	b1 := acquireBackend(ctx1, cfg, "first")
+	b2 := acquireBackend(ctx2, other, "second")
+	if b1 != b2 {
+		t.Fatal("expected instances with different tracking rules to share the backend")
+	}
+
+	batched := CreateConfig()
+	batched.UmamiHost = cfg.UmamiHost
+	batched.UmamiToken = cfg.UmamiToken
+	batched.BatchSize = 50
+	b3 := acquireBackend(context.Background(), batched, "third")
+	if b3 == b1 {
+		t.Fatal("expected instances with different delivery settings not to share the backend")
+	}
+
+	cancel1()
+	waitForBackendRefs(t, b1, 1)
+	if b1.ctx.Err() != nil {
+		t.Fatal("expected the backend to keep running while an instance uses it")
+	}
+
+	cancel2()
+	<-b1.ctx.Done()
+	backendsMutex.Lock()
+	_, ok := backends[b1.key]
+	backendsMutex.Unlock()
+	if ok {
+		t.Fatal("expected the released backend to be removed from the registry")
+	}
+}
+
+func waitForBackendRefs(t *testing.T, b *umamiBackend, expected int) {
+	t.Helper()
+	for range 100 {
+		backendsMutex.Lock()
+		refs := b.refs
+		backendsMutex.Unlock()
+		if refs == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d references to the backend", expected)
+}
+
+func TestSharedBackendConnectsOnce(t *testing.T) {
+	var logins, fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/auth/login":
+			logins.Add(1)
+			_, _ = rw.Write([]byte(`{"token":"token"}`))
+		case "/api/websites":
+			fetches.Add(1)
+			_, _ = rw.Write([]byte(`{"data":[{"id":"1","domain":"www.example.com"}],"count":1}`))
+		}
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+	cfg.UmamiUsername = "admin"
+	cfg.UmamiPassword = "umami"
+
+	backend := newUmamiBackend(cfg, "umami-feeder")
+	backend.endpoints[0].client = server.Client()
+
+	plain := &UmamiFeeder{backend: backend}
+	stripped := &UmamiFeeder{backend: backend, hosts: newHostCanonicalizer(true, nil)}
+	for _, feeder := range []*UmamiFeeder{plain, stripped, plain} {
+		if err := feeder.connect(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if logins.Load() != 1 || fetches.Load() != 1 {
+		t.Fatalf("expected a single login and fetch, got %d/%d", logins.Load(), fetches.Load())
+	}
+
+	// Each instance looks up the shared websites with its own canonical hosts.
+	assertWebsiteId(t, plain, "www.example.com", "1")
+	assertWebsiteId(t, plain, "example.com", "")
+	assertWebsiteId(t, stripped, "example.com", "1")
+}
+
+func TestSharedBackendRetriesOnce(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/auth/login" {
+			logins.Add(1)
+		}
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+	cfg.UmamiUsername = "admin"
+	cfg.UmamiPassword = "umami"
+
+	// While Umami is unavailable, the instances wait for the connection attempts of their backend.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for range 5 {
+		if _, err := New(ctx, http.NotFoundHandler(), cfg, "umami-feeder"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if logins.Load() != 1 {
+		t.Fatalf("expected a single login attempt, got %d", logins.Load())
+	}
+}
@@ -0,0 +1,108 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// size returns the length of the event in a serialized batch, including the separating comma.
+func (s *SendBody) size() int {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return 0
+	}
+	return len(content) + 1
+}
+
+// maxBatchEvents returns the current batch size, adapted to the latency of Umami and limited to the learned safe size.
+func (b *umamiBackend) maxBatchEvents() int {
+	limit := int(b.batchLimit.Load())
+	if limit < 1 {
+		limit = b.batchSize
+	}
+	if maxSafe := int(b.maxSafeBatch.Load()); maxSafe > 0 && maxSafe < limit {
+		limit = maxSafe
+	}
+	return max(limit, 1)
+}
+
+// fitsBatch reports whether an event of the given size may be added to a batch of batchBytes.
+func (b *umamiBackend) fitsBatch(batchBytes, eventBytes int) bool {
+	return b.batchMaxBytes <= 0 || batchBytes+eventBytes <= b.batchMaxBytes
+}
+
+// sendBatch sends the events to Umami. A batch rejected as too large is split in half and both halves are sent,
+// the rejected size is learned so later batches stay below it. A single event rejected as too large is dropped.
+// It returns the amount of leading events which were delivered, so only the rest is retried on failure.
+func (b *umamiBackend) sendBatch(ctx context.Context, events []*SendBody) (int, error) {
+	err := b.reportEventsToUmami(ctx, events)
+	if err == nil {
+		return len(events), nil
+	}
+	if !isPayloadTooLarge(err) {
+		return 0, err
+	}
+	if len(events) == 1 {
+		b.dropBatch(events, "event too large: "+err.Error())
+		return 1, nil
+	}
+
+	b.learnMaxBatch(len(events))
+	half := len(events) / 2
+	sent, err := b.sendBatch(ctx, events[:half])
+	if err != nil {
+		return sent, err
+	}
+	rest, err := b.sendBatch(ctx, events[half:])
+	return sent + rest, err
+}
+
+// learnMaxBatch limits the batch size to half of a batch which was rejected as too large.
+func (b *umamiBackend) learnMaxBatch(rejected int) {
+	limit := int64(max(rejected/2, 1))
+	for {
+		current := b.maxSafeBatch.Load()
+		if current > 0 && current <= limit {
+			return
+		}
+		if b.maxSafeBatch.CompareAndSwap(current, limit) {
+			b.error(fmt.Sprintf("batch of %d events rejected as too large, limiting batches to %d events", rejected, limit))
+			return
+		}
+	}
+}
+
+// adaptBatchSize grows the batch size by half while full batches are delivered faster than batchTargetLatency and
+// the queue holds more than a batch, up to batchMaxSize. Slow batches shrink it back towards batchSize.
+func (b *umamiBackend) adaptBatchSize(delivered int, latency time.Duration) {
+	if b.batchTargetLatency <= 0 || b.batchMaxSize <= b.batchSize {
+		return
+	}
+
+	limit := b.maxBatchEvents()
+	resized := limit
+	switch {
+	case latency < b.batchTargetLatency && delivered >= limit && len(b.queue) >= limit:
+		resized = min(limit+max(limit/2, 1), b.batchMaxSize)
+		if maxSafe := int(b.maxSafeBatch.Load()); maxSafe > 0 {
+			resized = min(resized, maxSafe)
+		}
+	case latency > b.batchTargetLatency && limit > b.batchSize:
+		resized = max(limit*3/4, b.batchSize)
+	}
+
+	if resized != limit {
+		b.batchLimit.Store(int64(resized))
+		b.debugf("batch of %d events took %v, batch size changed from %d to %d", delivered, latency, limit, resized)
+	}
+}
+
+// isPayloadTooLarge reports whether Umami or a proxy in front of it rejected the request body as too large.
+func isPayloadTooLarge(err error) bool {
+	var reqErr *requestError
+	return errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusRequestEntityTooLarge
+}
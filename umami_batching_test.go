@@ -0,0 +1,118 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliverBatchSplitsTooLarge(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var events []*SendBody
+		_ = json.NewDecoder(req.Body).Decode(&events)
+		if len(events) > 5 {
+			rw.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, len(events))
+		mu.Unlock()
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		endpoints: testEndpoints(server),
+		batchSize: 20,
+	}
+	events := make([]*SendBody, 10)
+	for i := range events {
+		events[i] = &SendBody{Type: "event", Payload: &UmamiEvent{Website: "1"}}
+	}
+
+	if _, delivered := backend.deliverBatch(context.Background(), events); !delivered {
+		t.Fatal("expected the split batch to be delivered")
+	}
+	if len(batches) != 2 || batches[0] != 5 || batches[1] != 5 {
+		t.Fatalf("expected two batches of 5 events, got %v", batches)
+	}
+	if backend.maxBatchEvents() != 5 {
+		t.Fatalf("expected the batch size to be limited to 5, got %d", backend.maxBatchEvents())
+	}
+	if backend.lostEvents.Load() != 0 {
+		t.Fatalf("expected no lost events, got %d", backend.lostEvents.Load())
+	}
+}
+
+func TestFillBatchMaxBytes(t *testing.T) {
+	event := &UmamiEvent{Website: "1", Url: "/" + strings.Repeat("a", 100)}
+	eventBytes := (&SendBody{Type: "event", Payload: event}).size()
+
+	backend := &umamiBackend{
+		queue:         make(chan *UmamiEvent, 10),
+		batchSize:     10,
+		batchMaxBytes: 3 * eventBytes,
+	}
+	for range 5 {
+		backend.queue <- event
+	}
+
+	batch, next := backend.fillBatch(nil, nil)
+	if len(batch) != 3 || next == nil {
+		t.Fatalf("expected a batch of 3 events and a carried event, got %d/%v", len(batch), next)
+	}
+	batch, next = backend.fillBatch(nil, next)
+	if len(batch) != 2 || next != nil {
+		t.Fatalf("expected a batch of the 2 remaining events, got %d/%v", len(batch), next)
+	}
+}
+
+func TestAdaptBatchSize(t *testing.T) {
+	backend := &umamiBackend{
+		queue:              make(chan *UmamiEvent, 100),
+		batchSize:          10,
+		batchMaxSize:       20,
+		batchTargetLatency: time.Second,
+	}
+	backend.batchLimit.Store(10)
+
+	// A shallow queue keeps the batch size.
+	backend.adaptBatchSize(10, time.Millisecond)
+	assertBatchLimit(t, backend, 10)
+
+	for range 50 {
+		backend.queue <- &UmamiEvent{}
+	}
+	backend.adaptBatchSize(10, time.Millisecond)
+	assertBatchLimit(t, backend, 15)
+	backend.adaptBatchSize(15, time.Millisecond)
+	assertBatchLimit(t, backend, 20)
+	backend.adaptBatchSize(20, time.Millisecond)
+	assertBatchLimit(t, backend, 20)
+
+	// Slow batches shrink it, down to batchSize.
+	backend.adaptBatchSize(20, 2*time.Second)
+	assertBatchLimit(t, backend, 15)
+	backend.adaptBatchSize(15, 2*time.Second)
+	backend.adaptBatchSize(11, 2*time.Second)
+	assertBatchLimit(t, backend, 10)
+
+	// The learned limit is never exceeded.
+	backend.learnMaxBatch(24)
+	backend.adaptBatchSize(10, time.Millisecond)
+	assertBatchLimit(t, backend, 12)
+}
+
+func assertBatchLimit(t *testing.T, backend *umamiBackend, expected int) {
+	t.Helper()
+	if limit := backend.maxBatchEvents(); limit != expected {
+		t.Fatalf("expected a batch size of %d, got %d", expected, limit)
+	}
+}
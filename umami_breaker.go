@@ -0,0 +1,187 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of the circuit breaker.
+const (
+	// breakerClosed lets all calls through.
+	breakerClosed int32 = iota
+	// breakerOpen rejects all calls until the open timeout elapsed.
+	breakerOpen
+	// breakerHalfOpen lets a single probe call through, its result closes or opens the breaker again.
+	breakerHalfOpen
+)
+
+var breakerStateNames = map[int32]string{
+	breakerClosed:   "closed",
+	breakerOpen:     "open",
+	breakerHalfOpen: "half-open",
+}
+
+// callResult is the result of a call passed through the circuit breaker.
+type callResult int
+
+const (
+	callSucceeded callResult = iota
+	callFailed
+	// callCanceled calls don't change the state.
+	callCanceled
+)
+
+// errCircuitOpen is returned for calls rejected by the open circuit breaker.
+var errCircuitOpen = errors.New("circuit breaker open, Umami is unavailable")
+
+// circuitBreaker is a transport wrapping all calls to Umami. It opens after threshold consecutive failures,
+// so calls fail at once instead of waiting for the request timeout while Umami is down.
+// Network errors and 5xx responses are failures.
+type circuitBreaker struct {
+	next        http.RoundTripper
+	threshold   int
+	openTimeout time.Duration
+	// onChange is called on every state transition, outside the lock.
+	onChange func(from, to int32, failures int)
+
+	// state is only changed with mu held, it may be read without for the metrics.
+	mu       sync.Mutex
+	state    atomic.Int32
+	failures int
+	openedAt time.Time
+	probing  bool
+	opened   atomic.Int64
+	rejected atomic.Int64
+}
+
+func newCircuitBreaker(next http.RoundTripper, threshold int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{next: next, threshold: threshold, openTimeout: openTimeout}
+}
+
+func (cb *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !cb.allow() {
+		cb.rejected.Add(1)
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, errCircuitOpen
+	}
+
+	resp, err := cb.next.RoundTrip(req)
+	switch {
+	case err != nil && errors.Is(req.Context().Err(), context.Canceled):
+		// Canceled by the caller, e.g. on shutdown, which says nothing about Umami. An expired deadline,
+		// e.g. the client timeout, is a failure: Umami did not answer in time.
+		cb.record(callCanceled)
+	case err != nil, resp.StatusCode >= 500:
+		cb.record(callFailed)
+	default:
+		cb.record(callSucceeded)
+	}
+	return resp, err
+}
+
+// allow reports whether a call may be made. Once the open timeout elapsed, the breaker is half-open
+// and lets the first call through as a probe.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	from := cb.state.Load()
+	switch from {
+	case breakerClosed:
+		cb.mu.Unlock()
+		return true
+	case breakerOpen:
+		if time.Since(cb.openedAt) < cb.openTimeout {
+			cb.mu.Unlock()
+			return false
+		}
+		cb.state.Store(breakerHalfOpen)
+	}
+
+	allowed := !cb.probing
+	cb.probing = true
+	failures := cb.failures
+	cb.mu.Unlock()
+
+	if from != breakerHalfOpen {
+		cb.notify(from, breakerHalfOpen, failures)
+	}
+	return allowed
+}
+
+// record updates the breaker with the result of a call.
+func (cb *circuitBreaker) record(result callResult) {
+	cb.mu.Lock()
+	from := cb.state.Load()
+	if from == breakerHalfOpen {
+		cb.probing = false
+	}
+
+	switch result {
+	case callSucceeded:
+		cb.failures = 0
+		if from != breakerClosed {
+			cb.state.Store(breakerClosed)
+		}
+	case callFailed:
+		cb.failures++
+		if from == breakerHalfOpen || (from == breakerClosed && cb.failures >= cb.threshold) {
+			cb.state.Store(breakerOpen)
+			cb.openedAt = time.Now()
+			cb.opened.Add(1)
+		}
+	}
+
+	to, failures := cb.state.Load(), cb.failures
+	cb.mu.Unlock()
+
+	if to != from {
+		cb.notify(from, to, failures)
+	}
+}
+
+// probeDelay returns how long calls are still rejected, 0 once the breaker lets a call through.
+func (cb *circuitBreaker) probeDelay() time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state.Load() != breakerOpen {
+		return 0
+	}
+	return max(cb.openTimeout-time.Since(cb.openedAt), 0)
+}
+
+func (cb *circuitBreaker) notify(from, to int32, failures int) {
+	if cb.onChange != nil {
+		cb.onChange(from, to, failures)
+	}
+}
+
+// probeDelay returns how long until the circuit breaker of any endpoint lets a call through.
+func (b *umamiBackend) probeDelay() time.Duration {
+	var delay time.Duration
+	for i, ep := range b.endpoints {
+		if ep.breaker == nil {
+			return 0
+		}
+		if epDelay := ep.breaker.probeDelay(); i == 0 || epDelay < delay {
+			delay = epDelay
+		}
+	}
+	return delay
+}
+
+// logBreakerChange logs the transitions of the circuit breaker of an endpoint.
+func (b *umamiBackend) logBreakerChange(ep *umamiEndpoint, from, to int32, failures int) {
+	if to == breakerOpen {
+		b.error(fmt.Sprintf("circuit breaker of %s changed from %s to %s after %d consecutive failures, calls are suspended for %v",
+			ep.url, breakerStateNames[from], breakerStateNames[to], failures, ep.breaker.openTimeout))
+		return
+	}
+	b.debugf("circuit breaker of %s changed from %s to %s", ep.url, breakerStateNames[from], breakerStateNames[to])
+}
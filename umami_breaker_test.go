@@ -0,0 +1,174 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	breaker := newCircuitBreaker(server.Client().Transport, 2, 50*time.Millisecond)
+	var transitions []string
+	breaker.onChange = func(from, to int32, failures int) {
+		transitions = append(transitions, breakerStateNames[to])
+	}
+	client := &http.Client{Transport: breaker}
+
+	call := func() error {
+		resp, err := sendRequest(context.Background(), client, server.URL, nil, nil)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	for range 2 {
+		if err := call(); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("expected the call to fail at Umami, got %v", err)
+		}
+	}
+	if err := call(); !errors.Is(err, errCircuitOpen) || calls.Load() != 2 {
+		t.Fatalf("expected the open breaker to reject the call, got %v after %d calls", err, calls.Load())
+	}
+
+	// The probe fails and opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	if err := call(); err == nil || errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the probe to fail at Umami, got %v", err)
+	}
+	if err := call(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the reopened breaker to reject the call, got %v", err)
+	}
+
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if err := call(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"open", "half-open", "open", "half-open", "closed"}
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected transitions %v, got %v", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("expected transitions %v, got %v", expected, transitions)
+		}
+	}
+	if breaker.opened.Load() != 2 || breaker.rejected.Load() != 2 {
+		t.Fatalf("expected 2 openings and 2 rejections, got %d/%d", breaker.opened.Load(), breaker.rejected.Load())
+	}
+}
+
+func TestCircuitBreakerTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	breaker := newCircuitBreaker(server.Client().Transport, 2, time.Hour)
+	client := &http.Client{Transport: breaker, Timeout: 50 * time.Millisecond}
+
+	// A hung Umami is a failure, even though the client timeout is a deadline of the request context.
+	for range 2 {
+		if _, err := sendRequest(context.Background(), client, server.URL, nil, nil); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("expected the call to time out, got %v", err)
+		}
+	}
+	if state := breaker.state.Load(); state != breakerOpen {
+		t.Fatalf("expected the breaker to be open, got %s", breakerStateNames[state])
+	}
+
+	// A call canceled by the caller is not counted.
+	breaker = newCircuitBreaker(server.Client().Transport, 1, time.Hour)
+	client = &http.Client{Transport: breaker}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := sendRequest(ctx, client, server.URL, nil, nil); err == nil {
+		t.Fatal("expected the call to be canceled")
+	}
+	if state := breaker.state.Load(); state != breakerClosed {
+		t.Fatalf("expected the breaker to stay closed, got %s", breakerStateNames[state])
+	}
+}
+
+func TestDeliverBatchCircuitOpen(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		rw.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	breaker := newCircuitBreaker(server.Client().Transport, 1, time.Hour)
+	breaker.record(callFailed)
+	backend := &umamiBackend{
+		endpoints:            []*umamiEndpoint{{url: server.URL, client: &http.Client{Transport: breaker}, breaker: breaker}},
+		retryMaxAttempts:     3,
+		retryInitialInterval: time.Millisecond,
+		retryMaxInterval:     time.Millisecond,
+		retryMaxAge:          time.Minute,
+	}
+
+	// The breaker stays open beyond the max age, so the batch is given up without waiting for it.
+	if _, delivered := backend.deliverBatch(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}}); delivered {
+		t.Fatal("expected the batch not to be delivered")
+	}
+	if calls.Load() != 0 || backend.lostEvents.Load() != 1 {
+		t.Fatalf("expected the event to be dropped without calling Umami, got %d calls", calls.Load())
+	}
+}
+
+func TestDeliverBatchShortOutage(t *testing.T) {
+	var calls atomic.Int32
+	recovered := time.Now().Add(300 * time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if time.Now().Before(recovered) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	breaker := newCircuitBreaker(server.Client().Transport, 2, 200*time.Millisecond)
+	backend := &umamiBackend{
+		endpoints:            []*umamiEndpoint{{url: server.URL, client: &http.Client{Transport: breaker}, breaker: breaker}},
+		retryMaxAttempts:     4,
+		retryInitialInterval: 10 * time.Millisecond,
+		retryMaxInterval:     10 * time.Millisecond,
+		retryMaxAge:          time.Minute,
+	}
+
+	// The breaker opens during the outage, the retries wait for its probes instead of being rejected.
+	if _, delivered := backend.deliverBatch(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}}); !delivered {
+		t.Fatal("expected the batch to be delivered after the outage")
+	}
+	if breaker.opened.Load() == 0 || breaker.rejected.Load() != 0 {
+		t.Fatalf("expected the breaker to open without rejecting a retry, got %d openings and %d rejections",
+			breaker.opened.Load(), breaker.rejected.Load())
+	}
+	if backend.lostEvents.Load() != 0 {
+		t.Fatalf("expected no lost events, got %d", backend.lostEvents.Load())
+	}
+}
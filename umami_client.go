@@ -0,0 +1,32 @@
+package traefik_umami_feeder
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient creates the client shared by all calls to an Umami endpoint, keeping connections alive between batches.
+func newHTTPClient(config *Config, umamiHost string) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		TLSClientConfig:       newTLSConfig(config, umamiHost),
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.RequestTimeout,
+	}
+}
@@ -0,0 +1,68 @@
+package traefik_umami_feeder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+)
+
+// CompressionGzip sends batches gzip-compressed.
+const CompressionGzip = "gzip"
+
+// batchHeaders returns the headers of a batch request, with the gzip encoding while Umami accepts it.
+func (b *umamiBackend) batchHeaders() http.Header {
+	if !b.gzipEnabled.Load() {
+		return nil
+	}
+	return http.Header{"Content-Encoding": {CompressionGzip}}
+}
+
+// probeCompression sends an empty compressed batch to detect whether Umami, or a reverse proxy in front of it,
+// accepts gzip-encoded bodies. Batches are sent uncompressed if it does not, or if the probe fails.
+func (b *umamiBackend) probeCompression(ctx context.Context) {
+	err := b.callEndpoints(func(ep *umamiEndpoint) error {
+		headers := http.Header{"Content-Encoding": {CompressionGzip}}
+		resp, err := sendRequest(ctx, ep.client, ep.url+"/api/batch", []*SendBody{}, headers)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+	if err != nil {
+		b.gzipEnabled.Store(false)
+		b.error("compressed batches are not accepted, sending them uncompressed: " + err.Error())
+		return
+	}
+
+	b.gzipEnabled.Store(true)
+	b.debugf("compressed batches are accepted")
+}
+
+// isUnsupportedEncoding reports whether a compressed request may have been rejected because of its Content-Encoding.
+// Besides 415, Umami answers 400 to a body it can't parse, so any client error is suspect except those which
+// have another cause: authentication, a too large batch or rate limiting.
+func isUnsupportedEncoding(err error) bool {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) || reqErr.StatusCode < 400 || reqErr.StatusCode >= 500 {
+		return false
+	}
+	switch reqErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+func gzipBody(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
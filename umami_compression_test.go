@@ -0,0 +1,109 @@
+package traefik_umami_feeder
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// newBatchServer returns a server accepting batches, compressed ones only if acceptGzip is set.
+// It counts the received compressed and uncompressed events.
+func newBatchServer(acceptGzip bool, compressed, plain *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body io.Reader = req.Body
+		gzipped := req.Header.Get("Content-Encoding") == CompressionGzip
+		if gzipped {
+			if !acceptGzip {
+				// Like Umami, which fails to parse the compressed body.
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			reader, err := gzip.NewReader(req.Body)
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = reader
+		}
+
+		var events []*SendBody
+		if err := json.NewDecoder(body).Decode(&events); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if gzipped {
+			compressed.Add(int32(len(events)))
+		} else {
+			plain.Add(int32(len(events)))
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+}
+
+func TestCompressionProbe(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		var compressed, plain atomic.Int32
+		server := newBatchServer(accept, &compressed, &plain)
+
+		backend := &umamiBackend{endpoints: testEndpoints(server), compression: CompressionGzip}
+		if err := backend.connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if backend.gzipEnabled.Load() != accept {
+			t.Fatalf("expected compression enabled to be %v", accept)
+		}
+
+		if err := backend.reportEventsToUmami(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}}); err != nil {
+			t.Fatal(err)
+		}
+		if accept && (compressed.Load() != 1 || plain.Load() != 0) {
+			t.Fatalf("expected a compressed event, got %d/%d", compressed.Load(), plain.Load())
+		}
+		if !accept && (compressed.Load() != 0 || plain.Load() != 1) {
+			t.Fatalf("expected an uncompressed event, got %d/%d", compressed.Load(), plain.Load())
+		}
+		server.Close()
+	}
+}
+
+func TestCompressionFallback(t *testing.T) {
+	var compressed, plain atomic.Int32
+	server := newBatchServer(false, &compressed, &plain)
+	defer server.Close()
+
+	// Compression was accepted by the probe, but is rejected later, e.g. by a reconfigured proxy.
+	backend := &umamiBackend{endpoints: testEndpoints(server), compression: CompressionGzip}
+	backend.gzipEnabled.Store(true)
+
+	if err := backend.reportEventsToUmami(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}}); err != nil {
+		t.Fatal(err)
+	}
+	if backend.gzipEnabled.Load() || plain.Load() != 1 {
+		t.Fatalf("expected the batch to be resent uncompressed, got %d uncompressed events", plain.Load())
+	}
+}
+
+func TestCompressionKeptForRejectedBatch(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	// A batch rejected uncompressed too is invalid, compression is not the cause.
+	backend := &umamiBackend{endpoints: testEndpoints(server), compression: CompressionGzip}
+	backend.gzipEnabled.Store(true)
+
+	if err := backend.reportEventsToUmami(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}}); err == nil {
+		t.Fatal("expected the batch to be rejected")
+	}
+	if !backend.gzipEnabled.Load() || requests.Load() != 2 {
+		t.Fatalf("expected compression to stay enabled after a single uncompressed resend, got %d requests", requests.Load())
+	}
+}
@@ -0,0 +1,127 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// FailoverPriority sends to the first available endpoint, the others are only used when it is down.
+	FailoverPriority = "priority"
+	// FailoverRoundRobin spreads the calls over the available endpoints.
+	FailoverRoundRobin = "round-robin"
+)
+
+// umamiEndpoint is one URL of Umami, with its own client and circuit breaker.
+// All endpoints must share the database, so the token and the website IDs are valid on each of them.
+type umamiEndpoint struct {
+	url     string
+	client  *http.Client
+	breaker *circuitBreaker
+	// down is set when a call failed, until a health check or a later call succeeds.
+	down atomic.Bool
+}
+
+func (b *umamiBackend) newEndpoint(config *Config, umamiHost string) *umamiEndpoint {
+	ep := &umamiEndpoint{url: umamiHost, client: newHTTPClient(config, umamiHost)}
+
+	if config.CircuitBreakerThreshold > 0 {
+		ep.breaker = newCircuitBreaker(ep.client.Transport, config.CircuitBreakerThreshold, config.CircuitBreakerOpenTimeout)
+		ep.breaker.onChange = func(from, to int32, failures int) {
+			b.logBreakerChange(ep, from, to, failures)
+		}
+		ep.client.Transport = ep.breaker
+	}
+	return ep
+}
+
+func isValidFailoverMode(mode string) bool {
+	return mode == FailoverPriority || mode == FailoverRoundRobin
+}
+
+// endpointOrder returns the endpoints in the order they are tried: the available ones first, starting with the
+// first one in priority mode or the next one in round-robin mode, then those which are down, as they may be back.
+func (b *umamiBackend) endpointOrder() []*umamiEndpoint {
+	start := 0
+	if b.failoverMode == FailoverRoundRobin && len(b.endpoints) > 1 {
+		start = int((b.nextEndpoint.Add(1) - 1) % int64(len(b.endpoints)))
+	}
+
+	ordered := make([]*umamiEndpoint, 0, len(b.endpoints))
+	var down []*umamiEndpoint
+	for i := range b.endpoints {
+		ep := b.endpoints[(start+i)%len(b.endpoints)]
+		if ep.down.Load() {
+			down = append(down, ep)
+		} else {
+			ordered = append(ordered, ep)
+		}
+	}
+	return append(ordered, down...)
+}
+
+// callEndpoints calls fn with the endpoints in failover order, until a call succeeds or fails permanently.
+// A call failing with a retryable error is repeated on the next endpoint, e.g. a batch sent to an unreachable
+// region is sent to the other one. The error of the last call is returned.
+func (b *umamiBackend) callEndpoints(fn func(ep *umamiEndpoint) error) error {
+	var err error
+	for _, ep := range b.endpointOrder() {
+		err = fn(ep)
+		if err != nil && isRetryableError(err) {
+			b.markEndpointDown(ep, err)
+			continue
+		}
+		// A permanent failure, e.g. 400 or 401, is still a response of a working endpoint.
+		if !errors.Is(err, context.Canceled) {
+			b.markEndpointUp(ep)
+		}
+		return err
+	}
+	return err
+}
+
+func (b *umamiBackend) markEndpointUp(ep *umamiEndpoint) {
+	if ep.down.CompareAndSwap(true, false) {
+		b.debugf("umami endpoint %s is available again", ep.url)
+	}
+}
+
+func (b *umamiBackend) markEndpointDown(ep *umamiEndpoint, err error) {
+	if len(b.endpoints) > 1 && ep.down.CompareAndSwap(false, true) {
+		b.error("umami endpoint " + ep.url + " is down, failing over: " + err.Error())
+	}
+}
+
+// startHealthChecker periodically calls the heartbeat of every endpoint, to fail over before a batch fails
+// and to return to an endpoint once it is back. Calls through an open circuit breaker fail at once,
+// after the open timeout the heartbeat is its probe.
+func (b *umamiBackend) startHealthChecker(ctx context.Context) {
+	ticker := time.NewTicker(b.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, ep := range b.endpoints {
+				if err := checkHeartbeat(ctx, ep); err != nil {
+					b.markEndpointDown(ep, err)
+				} else {
+					b.markEndpointUp(ep)
+				}
+			}
+		}
+	}
+}
+
+func checkHeartbeat(ctx context.Context, ep *umamiEndpoint) error {
+	resp, err := sendRequest(ctx, ep.client, ep.url+"/api/heartbeat", nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,82 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testEndpoints returns the server as the single endpoint of a backend.
+func testEndpoints(server *httptest.Server) []*umamiEndpoint {
+	return []*umamiEndpoint{{url: server.URL, client: server.Client()}}
+}
+
+func TestFailover(t *testing.T) {
+	var primaryCalls, secondaryCalls atomic.Int32
+	var primaryDown atomic.Bool
+	primaryDown.Store(true)
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		primaryCalls.Add(1)
+		if primaryDown.Load() {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		secondaryCalls.Add(1)
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer secondary.Close()
+
+	backend := &umamiBackend{
+		endpoints:    append(testEndpoints(primary), testEndpoints(secondary)...),
+		failoverMode: FailoverPriority,
+	}
+	batch := []*SendBody{{Type: "event", Payload: &UmamiEvent{}}}
+
+	// The batch failing on the primary is sent to the secondary, which is used while the primary is down.
+	for range 2 {
+		if err := backend.reportEventsToUmami(context.Background(), batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if primaryCalls.Load() != 1 || secondaryCalls.Load() != 2 || !backend.endpoints[0].down.Load() {
+		t.Fatalf("expected a failover to the secondary, got %d/%d calls", primaryCalls.Load(), secondaryCalls.Load())
+	}
+
+	// Once the heartbeat succeeds again, the primary is preferred.
+	primaryDown.Store(false)
+	if err := checkHeartbeat(context.Background(), backend.endpoints[0]); err != nil {
+		t.Fatal(err)
+	}
+	backend.markEndpointUp(backend.endpoints[0])
+	if err := backend.reportEventsToUmami(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+	if primaryCalls.Load() != 3 || secondaryCalls.Load() != 2 {
+		t.Fatalf("expected the primary to be used again, got %d/%d calls", primaryCalls.Load(), secondaryCalls.Load())
+	}
+}
+
+func TestEndpointOrderRoundRobin(t *testing.T) {
+	backend := &umamiBackend{
+		endpoints:    []*umamiEndpoint{{url: "a"}, {url: "b"}, {url: "c"}},
+		failoverMode: FailoverRoundRobin,
+	}
+	backend.endpoints[1].down.Store(true)
+
+	for _, expected := range []string{"a,c,b", "c,a,b", "c,a,b", "a,c,b"} {
+		var urls []string
+		for _, ep := range backend.endpointOrder() {
+			urls = append(urls, ep.url)
+		}
+		if got := strings.Join(urls, ","); got != expected {
+			t.Fatalf("expected endpoints %s, got %s", expected, got)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package traefik_umami_feeder
+
+import (
+	"cmp"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// hostPattern matches hostnames exactly, by a wildcard (e.g. `*.example.com`)
+// or by a regular expression enclosed in slashes (e.g. `/^pr-\d+\.example\.com$/`).
+type hostPattern struct {
+	pattern  string
+	wildcard bool
+	regexp   *regexp.Regexp
+}
+
+func compileHostPattern(pattern string) (*hostPattern, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		r, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile host pattern %s: %w", pattern, err)
+		}
+		return &hostPattern{pattern: pattern, regexp: r}, nil
+	}
+
+	pattern = strings.ToLower(pattern)
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %s: %w", pattern, err)
+		}
+		return &hostPattern{pattern: pattern, wildcard: true}, nil
+	}
+
+	return &hostPattern{pattern: pattern}, nil
+}
+
+func compileHostPatterns(patterns []string, hosts *hostCanonicalizer) ([]*hostPattern, error) {
+	compiled := make([]*hostPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		p, err := hosts.compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, p)
+	}
+	return compiled, nil
+}
+
+// Match reports whether the canonical hostname matches the pattern.
+func (p *hostPattern) Match(hostname string) bool {
+	switch {
+	case p.regexp != nil:
+		return p.regexp.MatchString(hostname)
+	case p.wildcard:
+		matched, _ := path.Match(p.pattern, hostname)
+		return matched
+	default:
+		return p.pattern == hostname
+	}
+}
+
+func matchAnyHostPattern(patterns []*hostPattern, hostname string) bool {
+	for _, p := range patterns {
+		if p.Match(hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExact reports whether the pattern matches a single hostname only.
+func (p *hostPattern) isExact() bool {
+	return p.regexp == nil && !p.wildcard
+}
+
+// websitePattern maps hostnames matching a wildcard or regular expression to a website.
+type websitePattern struct {
+	*hostPattern
+	websiteId string
+}
+
+// compileWebsitePatterns compiles the wildcard and regexp keys of websites, exact keys are skipped.
+// The patterns are ordered by precedence: wildcards, longest first, then regular expressions in lexical order.
+func compileWebsitePatterns(websites map[string]string, hosts *hostCanonicalizer) ([]websitePattern, error) {
+	var patterns []websitePattern
+	for key, websiteId := range websites {
+		p, err := hosts.compilePattern(key)
+		if err != nil {
+			return nil, err
+		}
+		if !p.isExact() {
+			patterns = append(patterns, websitePattern{hostPattern: p, websiteId: websiteId})
+		}
+	}
+
+	slices.SortFunc(patterns, func(a, b websitePattern) int {
+		return compareHostPatterns(a.hostPattern, b.hostPattern)
+	})
+	return patterns, nil
+}
+
+// compareHostPatterns orders patterns by precedence: exact hostnames, then wildcards, longest first,
+// then regular expressions in lexical order.
+func compareHostPatterns(a, b *hostPattern) int {
+	if rank, otherRank := a.rank(), b.rank(); rank != otherRank {
+		return rank - otherRank
+	}
+	if a.wildcard && len(a.pattern) != len(b.pattern) {
+		return len(b.pattern) - len(a.pattern)
+	}
+	return cmp.Compare(a.pattern, b.pattern)
+}
+
+func (p *hostPattern) rank() int {
+	switch {
+	case p.regexp != nil:
+		return 2
+	case p.wildcard:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// isHostPatternKey reports whether a key of websites is a wildcard or regular expression.
+func isHostPatternKey(key string) bool {
+	p, err := compileHostPattern(key)
+	return err != nil || !p.isExact()
+}
+
+// hostCanonicalizer maps the hostnames of requests and websites to their canonical form.
+type hostCanonicalizer struct {
+	stripWWW bool
+	aliases  map[string]string
+}
+
+func newHostCanonicalizer(stripWWW bool, aliases map[string]string) hostCanonicalizer {
+	c := hostCanonicalizer{stripWWW: stripWWW, aliases: make(map[string]string, len(aliases))}
+	for alias, hostname := range aliases {
+		c.aliases[c.normalize(alias)] = c.normalize(hostname)
+	}
+	return c
+}
+
+// canonical returns the hostname of a Host header, normalized by parseDomainFromHost,
+// without the "www." prefix if StripWWW is set and with HostAliases applied.
+func (c *hostCanonicalizer) canonical(host string) string {
+	hostname := c.normalize(host)
+	if alias, ok := c.aliases[hostname]; ok {
+		return alias
+	}
+	return hostname
+}
+
+// compilePattern compiles a host pattern of the configuration, to be matched against canonical hostnames.
+// Exact hostnames are canonicalized like the hosts of requests, so e.g. `www.example.com` matches with StripWWW.
+// The fixed suffix of a wildcard is converted to punycode, regular expressions are used as written.
+func (c *hostCanonicalizer) compilePattern(pattern string) (*hostPattern, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return compileHostPattern(pattern)
+	}
+
+	i := strings.LastIndexAny(pattern, "*?[]")
+	if i < 0 {
+		return compileHostPattern(c.canonical(pattern))
+	}
+	return compileHostPattern(pattern[:i+1] + hostnameToASCII(strings.ToLower(pattern[i+1:])))
+}
+
+func (c *hostCanonicalizer) normalize(host string) string {
+	hostname := parseDomainFromHost(host)
+	if rest, ok := strings.CutPrefix(hostname, "www."); ok && c.stripWWW && strings.Contains(rest, ".") {
+		hostname = rest
+	}
+	return hostname
+}
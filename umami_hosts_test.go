@@ -0,0 +1,159 @@
+package traefik_umami_feeder
+
+import "testing"
+
+func TestHostPattern(t *testing.T) {
+	assertHostPattern(t, "example.com", "example.com", true)
+	assertHostPattern(t, "Example.com", "example.com", true)
+	assertHostPattern(t, "example.com", "www.example.com", false)
+	assertHostPattern(t, "*.example.com", "www.example.com", true)
+	assertHostPattern(t, "*.example.com", "pr-1.preview.example.com", true)
+	assertHostPattern(t, "*.example.com", "example.com", false)
+	assertHostPattern(t, "*.example.com", "evil.example", false)
+	assertHostPattern(t, `/^pr-\d+\.example\.com$/`, "pr-123.example.com", true)
+	assertHostPattern(t, `/^pr-\d+\.example\.com$/`, "pr-abc.example.com", false)
+
+	if _, err := compileHostPattern("/[/"); err == nil {
+		t.Fatal("expected invalid regexp to fail")
+	}
+	if _, err := compileHostPattern("[.example.com"); err == nil {
+		t.Fatal("expected invalid wildcard to fail")
+	}
+}
+
+func assertHostPattern(t *testing.T, pattern, hostname string, expected bool) {
+	t.Helper()
+	p, err := compileHostPattern(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Match(hostname) != expected {
+		t.Fatalf("expected %v for %s matching %s", expected, hostname, pattern)
+	}
+}
+
+func TestShouldTrackCreateAllow(t *testing.T) {
+	feeder := &UmamiFeeder{backend: &umamiBackend{}, createNewWebsites: true, trackAllResources: true}
+	err := feeder.verifyConfig(&Config{
+		Websites:               map[string]string{"known.com": "1"},
+		CreateNewWebsitesAllow: []string{"*.ourcompany.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTrackHost(t, feeder, true, "http://www.ourcompany.com/")
+	assertTrackHost(t, feeder, true, "http://known.com/")
+	assertTrackHost(t, feeder, false, "http://evil.example/")
+}
+
+func TestWebsiteName(t *testing.T) {
+	feeder := &UmamiFeeder{name: "umami@file", createNewWebsitesName: "{{host}} ({{middleware}})"}
+	if name := feeder.websiteName("example.com"); name != "example.com (umami@file)" {
+		t.Fatalf("unexpected website name %s", name)
+	}
+}
+
+func TestWebsitePatternPrecedence(t *testing.T) {
+	feeder := &UmamiFeeder{backend: &umamiBackend{}}
+	err := feeder.verifyConfig(&Config{Websites: map[string]string{
+		"pr-1.preview.example.com":    "exact",
+		"*.example.com":               "wildcard",
+		"*.preview.example.com":       "preview",
+		`/^b-\d+\.example\.org$/`:     "regexp-b",
+		`/^[a-z]-\d+\.example\.org$/`: "regexp-a",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertWebsiteId(t, feeder, "pr-1.preview.example.com", "exact")
+	assertWebsiteId(t, feeder, "pr-2.preview.example.com", "preview")
+	assertWebsiteId(t, feeder, "www.example.com", "wildcard")
+	assertWebsiteId(t, feeder, "b-1.example.org", "regexp-a")
+	assertWebsiteId(t, feeder, "c-1.example.org", "regexp-a")
+	assertWebsiteId(t, feeder, "example.net", "")
+}
+
+func assertWebsiteId(t *testing.T, feeder *UmamiFeeder, hostname, expected string) {
+	t.Helper()
+	if websiteId, _ := feeder.getWebsiteId(hostname); websiteId != expected {
+		t.Fatalf("expected website %q for %s, got %q", expected, hostname, websiteId)
+	}
+}
+
+func TestParseDomainFromHost(t *testing.T) {
+	cases := map[string]string{
+		"example.com":        "example.com",
+		"Example.COM:8080":   "example.com",
+		"example.com.":       "example.com",
+		"[::1]:8080":         "::1",
+		"[2001:db8::1]":      "2001:db8::1",
+		"127.0.0.1:80":       "127.0.0.1",
+		"münchen.de":         "xn--mnchen-3ya.de",
+		"MÜNCHEN.de:443":     "xn--mnchen-3ya.de",
+		"xn--mnchen-3ya.de":  "xn--mnchen-3ya.de",
+		"bücher.example.com": "xn--bcher-kva.example.com",
+		"例え.テスト":             "xn--r8jz45g.xn--zckzah",
+	}
+	for host, expected := range cases {
+		if hostname := parseDomainFromHost(host); hostname != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, host, hostname)
+		}
+	}
+}
+
+func TestHostCanonicalizer(t *testing.T) {
+	c := newHostCanonicalizer(true, map[string]string{"old-brand.com": "Example.com", "www.legacy.org": "example.com"})
+
+	cases := map[string]string{
+		"www.example.com:443": "example.com",
+		"example.com":         "example.com",
+		"www.old-brand.com":   "example.com",
+		"legacy.org":          "example.com",
+		"www.com":             "www.com",
+		"blog.example.com":    "blog.example.com",
+	}
+	for host, expected := range cases {
+		if hostname := c.canonical(host); hostname != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, host, hostname)
+		}
+	}
+}
+
+func TestCanonicalRuleKeys(t *testing.T) {
+	enabled := true
+	feeder := &UmamiFeeder{
+		backend: &umamiBackend{},
+		hosts:   newHostCanonicalizer(true, map[string]string{"old-brand.com": "example.com"}),
+	}
+	err := feeder.verifyConfig(&Config{
+		Routes: []Route{
+			{Host: "www.example.com", PathPrefix: "/docs", WebsiteId: "docs"},
+			{Host: "*.Bücher.de", PathPrefix: "/", WebsiteId: "books"},
+		},
+		Hosts: map[string]HostConfig{
+			"www.shop.com":  {TrackErrors: &enabled},
+			"old-brand.com": {TrackAllResources: &enabled},
+		},
+		CreateNewWebsitesAllow: []string{"www.new.com", "old-brand.com", "münchen.de"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rule keys match the canonical hostnames of requests, without www., with aliases applied and in punycode.
+	assertRoute(t, feeder, "/docs", "example.com", "docs", "/docs")
+	assertRoute(t, feeder, "/", "shop.xn--bcher-kva.de", "books", "/")
+	if !feeder.resolveOptions(feeder.hosts.canonical("shop.com")).trackErrors {
+		t.Fatal("expected the hosts entry of www.shop.com to apply to shop.com")
+	}
+	if !feeder.resolveOptions(feeder.hosts.canonical("www.old-brand.com")).trackAllResources {
+		t.Fatal("expected the hosts entry of the alias to apply to its canonical host")
+	}
+	for _, host := range []string{"new.com", "www.example.com", "xn--mnchen-3ya.de"} {
+		if !feeder.isCreateWebsiteAllowed(feeder.hosts.canonical(host)) {
+			t.Fatalf("expected website creation to be allowed for %s", host)
+		}
+	}
+}
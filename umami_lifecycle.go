@@ -0,0 +1,68 @@
+package traefik_umami_feeder
+
+import (
+	"net/netip"
+	"regexp"
+)
+
+// Lifecycle states of an instance. Requests are only tracked in stateRunning.
+const (
+	// stateConnecting retrieves the token and fetches the websites, retrying with a backoff.
+	stateConnecting int32 = iota
+	// stateVerifying compiles the tracking rules and verifies the delivery settings.
+	stateVerifying
+	// stateRunning tracks requests.
+	stateRunning
+	// stateDisabled is entered when the plugin is disabled or its configuration is invalid.
+	stateDisabled
+	// stateStopped is entered when the context of the instance is done, it is final.
+	stateStopped
+)
+
+var stateNames = map[int32]string{
+	stateConnecting: "connecting",
+	stateVerifying:  "verifying",
+	stateRunning:    "running",
+	stateDisabled:   "disabled",
+	stateStopped:    "stopped",
+}
+
+// transition changes the state from one to another, it fails if the state was changed concurrently,
+// e.g. when the instance was stopped while connecting.
+func (h *UmamiFeeder) transition(from, to int32) bool {
+	if !h.state.CompareAndSwap(from, to) {
+		return false
+	}
+	h.debugf("state changed from %s to %s", stateNames[from], stateNames[to])
+	return true
+}
+
+// stop moves the instance to the final stateStopped.
+func (h *UmamiFeeder) stop() {
+	if from := h.state.Swap(stateStopped); from != stateStopped {
+		h.debugf("state changed from %s to %s", stateNames[from], stateNames[stateStopped])
+	}
+}
+
+// trackingRules holds the compiled rules of an instance. A rule set is never modified once it is stored,
+// it is replaced as a whole, so requests can read it without locking.
+type trackingRules struct {
+	staticWebsites         map[string]string
+	websitePatterns        []websitePattern
+	routes                 []websiteRoute
+	createNewWebsitesAllow []*hostPattern
+	ignorePrefixes         []netip.Prefix
+	ignoreRegexps          []regexp.Regexp
+	hostOverrides          []hostOverride
+}
+
+// emptyRules is used until the rules are compiled.
+var emptyRules = &trackingRules{}
+
+// rules returns the current tracking rules.
+func (h *UmamiFeeder) rules() *trackingRules {
+	if rules, ok := h.trackingRules.Load().(*trackingRules); ok {
+		return rules
+	}
+	return emptyRules
+}
@@ -0,0 +1,102 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLifecycleConcurrentStartup drives requests while the instance connects and compiles its rules,
+// it is meant to be run with the race detector.
+func TestLifecycleConcurrentStartup(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/auth/login":
+			_, _ = rw.Write([]byte(`{"token":"lifecycle-token"}`))
+		case "/api/websites":
+			_, _ = rw.Write([]byte(`{"data":[{"id":"1","domain":"example.com"}],"count":1}`))
+		case "/api/batch":
+			var events []*SendBody
+			_ = json.NewDecoder(req.Body).Decode(&events)
+			received.Add(int32(len(events)))
+		}
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+	cfg.UmamiUsername = "admin"
+	cfg.UmamiPassword = "umami"
+	cfg.BatchMaxWait = 10 * time.Millisecond
+	cfg.IgnoreIPs = []string{"10.0.0.0/8"}
+	cfg.IgnoreURLs = []string{"^/health"}
+	cfg.Hosts = map[string]HostConfig{"*.example.com": {IgnoreURLs: []string{"^/admin"}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	handler, err := New(ctx, next, cfg, "lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeder := handler.(*UmamiFeeder)
+
+	deadline := time.Now().Add(5 * time.Second)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Keep sending requests until a few of them were sent in the running state.
+			for running := 0; running < 20 && time.Now().Before(deadline); {
+				if feeder.state.Load() == stateRunning {
+					running++
+				}
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+				req.Header.Set("X-Real-IP", "192.0.2.1")
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if state := feeder.state.Load(); state != stateRunning {
+		t.Fatalf("expected state running, got %s", stateNames[state])
+	}
+	for received.Load() < 8*20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received.Load() < 8*20 {
+		t.Fatalf("expected at least %d events, got %d", 8*20, received.Load())
+	}
+
+	cancel()
+	<-feeder.backend.ctx.Done()
+	for feeder.state.Load() != stateStopped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := feeder.state.Load(); state != stateStopped {
+		t.Fatalf("expected state stopped, got %s", stateNames[state])
+	}
+}
+
+func TestLifecycleDisabled(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Enabled = false
+
+	handler, err := New(context.Background(), http.NotFoundHandler(), cfg, "disabled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := handler.(*UmamiFeeder).state.Load(); state != stateDisabled {
+		t.Fatalf("expected state disabled, got %s", stateNames[state])
+	}
+}
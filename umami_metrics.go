@@ -0,0 +1,78 @@
+package traefik_umami_feeder
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// serveMetrics writes the metrics of the backend in the Prometheus text format.
+// Instances sharing a backend report the same values.
+func (h *UmamiFeeder) serveMetrics(rw http.ResponseWriter) {
+	b := h.backend
+	var sb strings.Builder
+
+	writeMetric(&sb, "queue_length", "gauge", "Events waiting in the queue.", int64(len(b.queue)))
+	writeMetric(&sb, "dropped_events_total", "counter", "Events dropped because the queue was full.", b.droppedEvents.Load())
+	writeMetric(&sb, "lost_events_total", "counter", "Events which could not be delivered nor spooled.", b.lostEvents.Load())
+	writeMetric(&sb, "lost_batches_total", "counter", "Batches which could not be delivered nor spooled.", b.lostBatches.Load())
+	writeMetric(&sb, "batch_size", "gauge", "Current maximum of events per batch.", int64(b.maxBatchEvents()))
+
+	writeEndpointMetric(&sb, b.endpoints, "endpoint_up", "gauge", "Whether the endpoint is available: 1 up, 0 down.",
+		func(ep *umamiEndpoint) (int64, bool) {
+			if ep.down.Load() {
+				return 0, true
+			}
+			return 1, true
+		})
+	writeEndpointMetric(&sb, b.endpoints, "circuit_breaker_state", "gauge", "State of the circuit breaker: 0 closed, 1 open, 2 half-open.",
+		func(ep *umamiEndpoint) (int64, bool) {
+			if ep.breaker == nil {
+				return 0, false
+			}
+			return int64(ep.breaker.state.Load()), true
+		})
+	writeEndpointMetric(&sb, b.endpoints, "circuit_breaker_opened_total", "counter", "Times the circuit breaker opened.",
+		func(ep *umamiEndpoint) (int64, bool) {
+			if ep.breaker == nil {
+				return 0, false
+			}
+			return ep.breaker.opened.Load(), true
+		})
+	writeEndpointMetric(&sb, b.endpoints, "circuit_breaker_rejected_total", "counter", "Calls rejected by the open circuit breaker.",
+		func(ep *umamiEndpoint) (int64, bool) {
+			if ep.breaker == nil {
+				return 0, false
+			}
+			return ep.breaker.rejected.Load(), true
+		})
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte(sb.String()))
+}
+
+func writeMetric(sb *strings.Builder, name, kind, help string, value int64) {
+	name = "umami_feeder_" + name
+	_, _ = fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+// writeEndpointMetric writes a metric with a sample per endpoint, labeled with its URL.
+// Endpoints for which value reports no sample are skipped, the metric is omitted if there is none.
+func writeEndpointMetric(sb *strings.Builder, endpoints []*umamiEndpoint, name, kind, help string,
+	value func(ep *umamiEndpoint) (int64, bool),
+) {
+	name = "umami_feeder_" + name
+	header := false
+	for _, ep := range endpoints {
+		v, ok := value(ep)
+		if !ok {
+			continue
+		}
+		if !header {
+			_, _ = fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+			header = true
+		}
+		_, _ = fmt.Fprintf(sb, "%s{endpoint=%q} %d\n", name, ep.url, v)
+	}
+}
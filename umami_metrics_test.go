@@ -0,0 +1,43 @@
+package traefik_umami_feeder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeMetrics(t *testing.T) {
+	breaker := newCircuitBreaker(http.DefaultTransport, 1, time.Hour)
+	breaker.record(callFailed)
+	backend := &umamiBackend{
+		queue:     make(chan *UmamiEvent, 10),
+		batchSize: 20,
+		endpoints: []*umamiEndpoint{{url: "http://umami.test", breaker: breaker}},
+	}
+	backend.queue <- &UmamiEvent{}
+	backend.droppedEvents.Store(3)
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Fatal("expected the metrics request not to be passed on")
+	})
+	feeder := &UmamiFeeder{next: next, backend: backend, metricsPath: "/metrics"}
+
+	recorder := httptest.NewRecorder()
+	feeder.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, metric := range []string{
+		"umami_feeder_queue_length 1\n",
+		"umami_feeder_dropped_events_total 3\n",
+		"umami_feeder_batch_size 20\n",
+		"umami_feeder_endpoint_up{endpoint=\"http://umami.test\"} 1\n",
+		"umami_feeder_circuit_breaker_state{endpoint=\"http://umami.test\"} 1\n",
+		"umami_feeder_circuit_breaker_opened_total{endpoint=\"http://umami.test\"} 1\n",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Fatalf("expected %q in the metrics:\n%s", metric, body)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package traefik_umami_feeder
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+// HostConfig overrides the tracking options for the hosts matching its key in Config.Hosts.
+// Options which are not set are inherited from the global configuration.
+type HostConfig struct {
+	// TrackErrors overrides Config.TrackErrors.
+	TrackErrors *bool `json:"trackErrors,omitempty"`
+	// TrackAllResources overrides Config.TrackAllResources.
+	TrackAllResources *bool `json:"trackAllResources,omitempty"`
+	// TrackExtensions overrides Config.TrackExtensions.
+	TrackExtensions []string `json:"trackExtensions,omitempty"`
+	// IgnoreURLs overrides Config.IgnoreURLs.
+	IgnoreURLs []string `json:"ignoreURLs,omitempty"`
+	// CaptureHeaders overrides Config.CaptureHeaders.
+	CaptureHeaders map[string]string `json:"captureHeaders,omitempty"`
+}
+
+// trackOptions are the tracking options in effect for a request.
+type trackOptions struct {
+	trackErrors       bool
+	trackAllResources bool
+	trackExtensions   []string
+	ignoreRegexps     []regexp.Regexp
+	captureHeaders    map[string]string
+}
+
+// hostOverride is a compiled HostConfig.
+type hostOverride struct {
+	*hostPattern
+	trackErrors       *bool
+	trackAllResources *bool
+	trackExtensions   []string
+	ignoreRegexps     []regexp.Regexp
+	captureHeaders    map[string]string
+}
+
+// compileHostOverrides compiles the host configurations, ordered by the precedence of their host patterns.
+func compileHostOverrides(hosts map[string]HostConfig, canonicalizer *hostCanonicalizer) ([]hostOverride, error) {
+	overrides := make([]hostOverride, 0, len(hosts))
+	for host, hostConfig := range hosts {
+		p, err := canonicalizer.compilePattern(host)
+		if err != nil {
+			return nil, err
+		}
+
+		override := hostOverride{
+			hostPattern:       p,
+			trackErrors:       hostConfig.TrackErrors,
+			trackAllResources: hostConfig.TrackAllResources,
+			trackExtensions:   hostConfig.TrackExtensions,
+			captureHeaders:    hostConfig.CaptureHeaders,
+		}
+		if hostConfig.IgnoreURLs != nil {
+			override.ignoreRegexps, err = compileIgnoreURLs(hostConfig.IgnoreURLs)
+			if err != nil {
+				return nil, fmt.Errorf("host %s: %w", host, err)
+			}
+		}
+		overrides = append(overrides, override)
+	}
+
+	slices.SortFunc(overrides, func(a, b hostOverride) int {
+		return compareHostPatterns(a.hostPattern, b.hostPattern)
+	})
+	return overrides, nil
+}
+
+func compileIgnoreURLs(ignoreURLs []string) ([]regexp.Regexp, error) {
+	regexps := make([]regexp.Regexp, 0, len(ignoreURLs))
+	for _, location := range ignoreURLs {
+		r, err := regexp.Compile(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile ignoreURL %s: %w", location, err)
+		}
+		regexps = append(regexps, *r)
+	}
+	return regexps, nil
+}
+
+// defaultOptions returns the global tracking options.
+func (h *UmamiFeeder) defaultOptions() *trackOptions {
+	return &trackOptions{
+		trackErrors:       h.trackErrors,
+		trackAllResources: h.trackAllResources,
+		trackExtensions:   h.trackExtensions,
+		ignoreRegexps:     h.rules().ignoreRegexps,
+		captureHeaders:    h.captureHeaders,
+	}
+}
+
+// resolveOptions returns the tracking options of a host, the first matching host override is merged over the global options.
+func (h *UmamiFeeder) resolveOptions(hostname string) *trackOptions {
+	opts := h.defaultOptions()
+	hostOverrides := h.rules().hostOverrides
+	for i := range hostOverrides {
+		override := &hostOverrides[i]
+		if !override.Match(hostname) {
+			continue
+		}
+
+		if override.trackErrors != nil {
+			opts.trackErrors = *override.trackErrors
+		}
+		if override.trackAllResources != nil {
+			opts.trackAllResources = *override.trackAllResources
+		}
+		if override.trackExtensions != nil {
+			opts.trackExtensions = override.trackExtensions
+		}
+		if override.ignoreRegexps != nil {
+			opts.ignoreRegexps = override.ignoreRegexps
+		}
+		if override.captureHeaders != nil {
+			opts.captureHeaders = override.captureHeaders
+		}
+		break
+	}
+	return opts
+}
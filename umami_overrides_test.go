@@ -0,0 +1,61 @@
+package traefik_umami_feeder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveOptions(t *testing.T) {
+	enabled := true
+	feeder := &UmamiFeeder{
+		trackErrors:    false,
+		captureHeaders: map[string]string{},
+	}
+	err := feeder.verifyConfig(&Config{
+		IgnoreURLs: []string{"^/health"},
+		Hosts: map[string]HostConfig{
+			"www.example.com": {TrackErrors: &enabled},
+			"*.example.com":   {TrackAllResources: &enabled, IgnoreURLs: []string{"^/admin"}},
+			"dashboard.internal": {
+				CaptureHeaders: map[string]string{"X-Auth-Request-User": "user"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The exact host wins over the wildcard, options which are not overridden are inherited.
+	options := feeder.resolveOptions("www.example.com")
+	if !options.trackErrors || options.trackAllResources || len(options.ignoreRegexps) != 1 {
+		t.Fatalf("unexpected options for www.example.com: %+v", options)
+	}
+
+	options = feeder.resolveOptions("shop.example.com")
+	if options.trackErrors || !options.trackAllResources {
+		t.Fatalf("unexpected options for shop.example.com: %+v", options)
+	}
+	assertIgnoreUrlWithOptions(t, feeder, options, true, "/health")
+	assertIgnoreUrlWithOptions(t, feeder, options, false, "/admin/users")
+
+	options = feeder.resolveOptions("dashboard.internal")
+	if options.captureHeaders["X-Auth-Request-User"] != "user" {
+		t.Fatalf("unexpected options for dashboard.internal: %+v", options)
+	}
+
+	options = feeder.resolveOptions("other.org")
+	if options.trackErrors || options.trackAllResources || len(options.captureHeaders) != 0 {
+		t.Fatalf("unexpected options for other.org: %+v", options)
+	}
+	assertIgnoreUrlWithOptions(t, feeder, options, false, "/health")
+}
+
+func assertIgnoreUrlWithOptions(t *testing.T, feeder *UmamiFeeder, options *trackOptions, expected bool, url string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+
+	if expected != feeder.shouldTrackRequest(req, options) {
+		t.Fatalf("expected %v for %s", expected, url)
+	}
+}
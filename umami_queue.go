@@ -0,0 +1,144 @@
+package traefik_umami_feeder
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Queue overflow policies, applied when an event is submitted while the queue is full.
+const (
+	// OverflowDropNewest drops the submitted event.
+	OverflowDropNewest = "drop-newest"
+	// OverflowDropOldest evicts the head of the queue to make room for the submitted event.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowBlock waits up to QueueBlockTimeout for room in the queue, then drops the submitted event.
+	OverflowBlock = "block"
+	// OverflowSample drops a deterministic fraction of events once the queue is above QueueSampleHighWater.
+	OverflowSample = "sample"
+)
+
+// dropLogInterval defines how often a summary of dropped events is logged.
+const dropLogInterval = 10 * time.Second
+
+func isValidOverflowPolicy(policy string) bool {
+	switch policy {
+	case OverflowDropNewest, OverflowDropOldest, OverflowBlock, OverflowSample:
+		return true
+	}
+	return false
+}
+
+// enqueue submits an event to the queue, applying the overflow policy when the queue is full.
+// With the spool enabled, events which don't fit into the queue are spooled instead of dropped.
+func (b *umamiBackend) enqueue(event *UmamiEvent) {
+	if b.queueOverflowPolicy == OverflowSample && !b.sampleEvent() {
+		b.recordDrop()
+		return
+	}
+
+	select {
+	case b.queue <- event:
+		return
+	default:
+	}
+
+	switch b.queueOverflowPolicy {
+	case OverflowDropOldest:
+		if b.spool == nil && b.enqueueEvictingOldest(event) {
+			return
+		}
+	case OverflowBlock:
+		timer := time.NewTimer(b.queueBlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case b.queue <- event:
+			return
+		case <-timer.C:
+		}
+	}
+
+	if b.spool != nil {
+		b.spoolEvents([]*UmamiEvent{event})
+		return
+	}
+	b.recordDrop()
+}
+
+// enqueueEvictingOldest removes events from the head of the queue until the event fits in.
+func (b *umamiBackend) enqueueEvictingOldest(event *UmamiEvent) bool {
+	for range 3 {
+		select {
+		case <-b.queue:
+			b.recordDrop()
+		default:
+		}
+
+		select {
+		case b.queue <- event:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// sampleEvent reports whether the event should be kept. Below the high-water mark all events are kept,
+// above it every event is kept with the ratio QueueSampleRatio, decided by a counter to stay deterministic.
+func (b *umamiBackend) sampleEvent() bool {
+	if len(b.queue) < b.queueSampleHighWater {
+		return true
+	}
+
+	n := float64(b.sampleCounter.Add(1))
+	return math.Floor(n*b.queueSampleRatio) > math.Floor((n-1)*b.queueSampleRatio)
+}
+
+// recordDrop counts a dropped event, the drops are logged as a summary at most once per dropLogInterval.
+func (b *umamiBackend) recordDrop() {
+	b.droppedEvents.Add(1)
+	b.drops.add()
+	b.logDrops()
+}
+
+// logDrops logs the summary of dropped events if the log interval has elapsed.
+func (b *umamiBackend) logDrops() {
+	if count, elapsed := b.drops.flush(dropLogInterval); count > 0 {
+		b.error(fmt.Sprintf("dropped %d events in last %v (queue full, policy %s), dropped so far: %d events",
+			count, elapsed.Round(time.Second), b.queueOverflowPolicy, b.droppedEvents.Load()))
+	}
+}
+
+// dropSummary accumulates dropped events between two log lines.
+type dropSummary struct {
+	mu          sync.Mutex
+	count       int64
+	windowStart time.Time
+}
+
+func (d *dropSummary) add() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.count == 0 {
+		d.windowStart = time.Now()
+	}
+	d.count++
+}
+
+// flush returns and resets the amount of drops if the window is older than interval.
+func (d *dropSummary) flush(interval time.Duration) (int64, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elapsed := time.Since(d.windowStart)
+	if d.count == 0 || elapsed < interval {
+		return 0, 0
+	}
+
+	count := d.count
+	d.count = 0
+	return count, elapsed
+}
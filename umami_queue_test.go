@@ -0,0 +1,94 @@
+package traefik_umami_feeder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnqueueDropNewest(t *testing.T) {
+	backend := &umamiBackend{queue: make(chan *UmamiEvent, 2), queueOverflowPolicy: OverflowDropNewest}
+
+	backend.enqueue(&UmamiEvent{Url: "/a"})
+	backend.enqueue(&UmamiEvent{Url: "/b"})
+	backend.enqueue(&UmamiEvent{Url: "/c"})
+
+	assertQueue(t, backend, "/a", "/b")
+	if backend.droppedEvents.Load() != 1 {
+		t.Fatalf("expected 1 dropped event, got %d", backend.droppedEvents.Load())
+	}
+}
+
+func TestEnqueueDropOldest(t *testing.T) {
+	backend := &umamiBackend{queue: make(chan *UmamiEvent, 2), queueOverflowPolicy: OverflowDropOldest}
+
+	backend.enqueue(&UmamiEvent{Url: "/a"})
+	backend.enqueue(&UmamiEvent{Url: "/b"})
+	backend.enqueue(&UmamiEvent{Url: "/c"})
+
+	assertQueue(t, backend, "/b", "/c")
+	if backend.droppedEvents.Load() != 1 {
+		t.Fatalf("expected 1 dropped event, got %d", backend.droppedEvents.Load())
+	}
+}
+
+func TestEnqueueBlock(t *testing.T) {
+	backend := &umamiBackend{queue: make(chan *UmamiEvent, 1), queueOverflowPolicy: OverflowBlock, queueBlockTimeout: time.Second}
+	backend.enqueue(&UmamiEvent{Url: "/a"})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-backend.queue
+	}()
+	backend.enqueue(&UmamiEvent{Url: "/b"})
+
+	assertQueue(t, backend, "/b")
+	if backend.droppedEvents.Load() != 0 {
+		t.Fatalf("expected no dropped events, got %d", backend.droppedEvents.Load())
+	}
+}
+
+func TestEnqueueSample(t *testing.T) {
+	backend := &umamiBackend{
+		queue:                make(chan *UmamiEvent, 100),
+		queueOverflowPolicy:  OverflowSample,
+		queueSampleHighWater: 10,
+		queueSampleRatio:     0.25,
+	}
+
+	for range 50 {
+		backend.enqueue(&UmamiEvent{})
+	}
+
+	// The first 10 events are below the high-water mark, one in four of the remaining 40 is kept.
+	if len(backend.queue) != 20 || backend.droppedEvents.Load() != 30 {
+		t.Fatalf("expected 20 queued and 30 dropped events, got %d/%d", len(backend.queue), backend.droppedEvents.Load())
+	}
+}
+
+func TestDropSummary(t *testing.T) {
+	var drops dropSummary
+	drops.add()
+	drops.add()
+
+	if count, _ := drops.flush(time.Hour); count != 0 {
+		t.Fatalf("expected no flush within the interval, got %d", count)
+	}
+	if count, _ := drops.flush(0); count != 2 {
+		t.Fatalf("expected 2 drops, got %d", count)
+	}
+	if count, _ := drops.flush(0); count != 0 {
+		t.Fatalf("expected reset after flush, got %d", count)
+	}
+}
+
+func assertQueue(t *testing.T, backend *umamiBackend, urls ...string) {
+	t.Helper()
+	if len(backend.queue) != len(urls) {
+		t.Fatalf("expected %d queued events, got %d", len(urls), len(backend.queue))
+	}
+	for _, url := range urls {
+		if event := <-backend.queue; event.Url != url {
+			t.Fatalf("expected %s, got %s", url, event.Url)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package traefik_umami_feeder
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+var redactPatterns = []*regexp.Regexp{
+	// Authorization headers, in header or JSON notation, including the scheme.
+	regexp.MustCompile(`(?i)((?:proxy-)?authorization"?\s*[:=]\s*"?)(?:(?:bearer|basic)\s+)?[^\s",}]+`),
+	// Bearer tokens anywhere in the message.
+	regexp.MustCompile(`(?i)(bearer\s+)[a-z0-9\-._~+/]+=*`),
+	// Token and password fields in JSON bodies.
+	regexp.MustCompile(`(?i)("(?:token|password)"\s*:\s*")[^"]*`),
+	// JSON Web Tokens.
+	regexp.MustCompile(`()eyJ[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]+\.[a-zA-Z0-9_-]*`),
+}
+
+// redact masks secrets in a log message: the current token, the password,
+// authorization headers, bearer tokens, token/password JSON fields and JWTs.
+func (b *umamiBackend) redact(message string) string {
+	b.tokenMutex.RLock()
+	token, password := b.umamiToken, b.umamiPassword
+	b.tokenMutex.RUnlock()
+
+	return redactSecrets(message, token, password)
+}
+
+// redact masks secrets in a log message, see umamiBackend.redact.
+func (h *UmamiFeeder) redact(message string) string {
+	if h.backend == nil {
+		return redactSecrets(message)
+	}
+	return h.backend.redact(message)
+}
+
+// redactSecrets masks the given secrets and the secrets matched by redactPatterns in a log message.
+func redactSecrets(message string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			message = strings.ReplaceAll(message, secret, redacted)
+		}
+	}
+
+	for _, pattern := range redactPatterns {
+		message = pattern.ReplaceAllString(message, "${1}"+redacted)
+	}
+	return message
+}
+
+// isSensitiveHeader reports whether the values of a header must not be logged.
+func (h *UmamiFeeder) isSensitiveHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return slices.ContainsFunc(h.sensitiveHeaders, func(sensitive string) bool {
+		return http.CanonicalHeaderKey(sensitive) == name
+	})
+}
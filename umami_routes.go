@@ -0,0 +1,93 @@
+package traefik_umami_feeder
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Route maps requests of a host with a path prefix to a website.
+type Route struct {
+	// Host is a hostname, a wildcard (`*.example.com`) or a regular expression enclosed in slashes.
+	Host string `json:"host"`
+	// PathPrefix is matched against the request path on segment boundaries, `/docs` matches `/docs/intro` but not `/docsearch`.
+	PathPrefix string `json:"pathPrefix"`
+	// WebsiteId is the website which receives the matching requests.
+	WebsiteId string `json:"websiteId"`
+	// StripPrefix removes the PathPrefix from the reported URL.
+	StripPrefix bool `json:"stripPrefix"`
+}
+
+type websiteRoute struct {
+	host        *hostPattern
+	pathPrefix  string
+	websiteId   string
+	stripPrefix bool
+}
+
+// compileRoutes validates the routes and orders them by precedence, longest path prefix first.
+func compileRoutes(routes []Route, hosts *hostCanonicalizer) ([]websiteRoute, error) {
+	compiled := make([]websiteRoute, 0, len(routes))
+	for _, route := range routes {
+		if route.WebsiteId == "" {
+			return nil, fmt.Errorf("route %s%s has no websiteId", route.Host, route.PathPrefix)
+		}
+
+		host, err := hosts.compilePattern(route.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		pathPrefix := "/" + strings.Trim(route.PathPrefix, "/")
+		compiled = append(compiled, websiteRoute{
+			host:        host,
+			pathPrefix:  pathPrefix,
+			websiteId:   route.WebsiteId,
+			stripPrefix: route.StripPrefix,
+		})
+	}
+
+	slices.SortStableFunc(compiled, func(a, b websiteRoute) int {
+		return len(b.pathPrefix) - len(a.pathPrefix)
+	})
+	return compiled, nil
+}
+
+func (r *websiteRoute) matchPath(path string) bool {
+	if r.pathPrefix == "/" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, r.pathPrefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// reportedUrl returns the URL reported to Umami, without the path prefix if StripPrefix is set.
+func (r *websiteRoute) reportedUrl(u *url.URL) string {
+	if !r.stripPrefix || r.pathPrefix == "/" {
+		return u.String()
+	}
+
+	stripped := *u
+	stripped.Path = strings.TrimPrefix(u.Path, r.pathPrefix)
+	stripped.RawPath = ""
+	if !strings.HasPrefix(stripped.Path, "/") {
+		stripped.Path = "/" + stripped.Path
+	}
+	return stripped.String()
+}
+
+// resolveWebsite returns the website of a request and the URL to report. Routes take precedence,
+// the longest matching path prefix wins, otherwise the website is looked up by hostname.
+func (h *UmamiFeeder) resolveWebsite(hostname string, u *url.URL) (string, string, bool) {
+	routes := h.rules().routes
+	for i := range routes {
+		route := &routes[i]
+		if route.host.Match(hostname) && route.matchPath(u.Path) {
+			return route.websiteId, route.reportedUrl(u), true
+		}
+	}
+
+	websiteId, ok := h.getWebsiteId(hostname)
+	return websiteId, u.String(), ok
+}
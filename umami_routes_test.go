@@ -0,0 +1,45 @@
+package traefik_umami_feeder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveWebsiteRoutes(t *testing.T) {
+	feeder := &UmamiFeeder{backend: &umamiBackend{}}
+	err := feeder.verifyConfig(&Config{
+		Websites: map[string]string{"example.com": "root"},
+		Routes: []Route{
+			{Host: "example.com", PathPrefix: "/docs", WebsiteId: "docs", StripPrefix: true},
+			{Host: "example.com", PathPrefix: "/docs/api/", WebsiteId: "api"},
+			{Host: "*.example.com", PathPrefix: "/blog", WebsiteId: "blog"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRoute(t, feeder, "/docs", "example.com", "docs", "/")
+	assertRoute(t, feeder, "/docs/intro?page=2", "example.com", "docs", "/intro?page=2")
+	assertRoute(t, feeder, "/docs/api/v1", "example.com", "api", "/docs/api/v1")
+	assertRoute(t, feeder, "/docsearch", "example.com", "root", "/docsearch")
+	assertRoute(t, feeder, "/blog/post", "www.example.com", "blog", "/blog/post")
+	assertRoute(t, feeder, "/", "example.com", "root", "/")
+
+	if err := feeder.verifyConfig(&Config{Routes: []Route{{Host: "example.com", PathPrefix: "/app"}}}); err == nil {
+		t.Fatal("expected route without websiteId to fail")
+	}
+}
+
+func assertRoute(t *testing.T, feeder *UmamiFeeder, url, host, expectedWebsite, expectedUrl string) {
+	t.Helper()
+	// Requests received by Traefik carry the path and query only, the host is set separately.
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req.Host = host
+
+	websiteId, eventUrl, ok := feeder.resolveWebsite(parseDomainFromHost(req.Host), req.URL)
+	if !ok || websiteId != expectedWebsite || eventUrl != expectedUrl {
+		t.Fatalf("expected %s %s for %s, got %s %s", expectedWebsite, expectedUrl, url, websiteId, eventUrl)
+	}
+}
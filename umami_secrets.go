@@ -0,0 +1,81 @@
+package traefik_umami_feeder
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envReferenceRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} references with the value of the environment variable NAME.
+// Unlike os.ExpandEnv, a plain $ is kept as is, and an unset variable is an error.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envReferenceRegexp.ReplaceAllStringFunc(value, func(reference string) string {
+		name := envReferenceRegexp.FindStringSubmatch(reference)[1]
+		envValue, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return envValue
+	})
+	return expanded, err
+}
+
+// resolveSecret returns the content of file if it is set, otherwise the value with environment references expanded.
+func resolveSecret(value, file string) (string, error) {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	return expandEnv(value)
+}
+
+// expandWebsites expands environment references in the domains and website IDs.
+func expandWebsites(websites map[string]string) (map[string]string, error) {
+	expanded := make(map[string]string, len(websites))
+	for domain, websiteId := range websites {
+		expandedDomain, err := expandEnv(domain)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve website %s: %w", domain, err)
+		}
+		expandedId, err := expandEnv(websiteId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve website %s: %w", domain, err)
+		}
+		expanded[expandedDomain] = expandedId
+	}
+	return expanded, nil
+}
+
+// loadToken resolves the configured token from UmamiTokenFile or UmamiToken.
+func (b *umamiBackend) loadToken() error {
+	token, err := resolveSecret(b.umamiTokenValue, b.umamiTokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve umamiToken: %w", err)
+	}
+
+	b.tokenMutex.Lock()
+	b.umamiToken = token
+	b.tokenMutex.Unlock()
+	return nil
+}
+
+// loadPassword resolves the password from UmamiPasswordFile or UmamiPassword.
+func (b *umamiBackend) loadPassword() (string, error) {
+	password, err := resolveSecret(b.umamiPasswordValue, b.umamiPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve umamiPassword: %w", err)
+	}
+
+	b.tokenMutex.Lock()
+	b.umamiPassword = password
+	b.tokenMutex.Unlock()
+	return password, nil
+}
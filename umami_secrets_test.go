@@ -0,0 +1,74 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("UMAMI_TEST_TOKEN", "secret")
+
+	value, err := expandEnv("${UMAMI_TEST_TOKEN}")
+	if err != nil || value != "secret" {
+		t.Fatalf("expected secret, got %q (%v)", value, err)
+	}
+
+	value, err = expandEnv("pa$$word-$UMAMI_TEST_TOKEN")
+	if err != nil || value != "pa$$word-$UMAMI_TEST_TOKEN" {
+		t.Fatalf("expected value without braces to be kept, got %q (%v)", value, err)
+	}
+
+	if _, err = expandEnv("${UMAMI_TEST_UNSET}"); err == nil {
+		t.Fatal("expected error for unset variable")
+	}
+}
+
+func TestResolveSecretFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := resolveSecret("ignored", file)
+	if err != nil || value != "from-file" {
+		t.Fatalf("expected from-file, got %q (%v)", value, err)
+	}
+}
+
+func TestTokenFileRefresh(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer rotated" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = rw.Write([]byte(`{"data":[]}`))
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("initial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &umamiBackend{endpoints: testEndpoints(server), umamiTokenFile: file}
+	if err := backend.loadToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret is rotated while the plugin is running.
+	if err := os.WriteFile(file, []byte("rotated"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := backend.withToken(context.Background(), func(token string) error {
+		_, err := fetchWebsites(context.Background(), backend.endpoints[0].client, backend.endpoints[0].url, token, "")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
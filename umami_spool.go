@@ -0,0 +1,431 @@
+package traefik_umami_feeder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spoolSegmentPrefix = "segment-"
+	spoolSegmentSuffix = ".jsonl"
+	// spoolSegmentMaxBytes defines the size after which the active segment is rotated.
+	spoolSegmentMaxBytes = 1 << 20
+	// spoolMaxLineBytes defines the largest event line accepted when reading a segment.
+	spoolMaxLineBytes = 1 << 20
+)
+
+// eventSpool is a disk-backed buffer of events, stored as a directory of append-only JSONL segment files.
+// Events are appended to the active (newest) segment, segments are drained oldest first.
+type eventSpool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	// refs counts the backends using the spool, it is guarded by spoolsMutex.
+	refs int
+
+	mu         sync.Mutex
+	active     *os.File
+	activeName string
+	activeSize int64
+	// totalBytes is the size of all segments, kept up to date so the size cap is enforced without listing the directory.
+	totalBytes int64
+	draining   string
+	drainBusy  atomic.Bool
+	lastSeq    int64
+}
+
+var (
+	// spools holds the open spools by directory. Backends using the same directory, e.g. with different delivery
+	// settings or while an old and a new configuration overlap on reload, share one spool, so no spool removes
+	// the active segment of another.
+	spools      = map[string]*eventSpool{}
+	spoolsMutex sync.Mutex
+)
+
+// spoolDrainResult summarizes a drain run.
+type spoolDrainResult struct {
+	Sent    int
+	Expired int
+	Corrupt int
+}
+
+// newEventSpool opens the spool of the directory, the spool already open for it is shared.
+// The size cap and max age of the first user apply. Every spool must be closed with Close.
+func newEventSpool(dir string, maxBytes int64, maxAge time.Duration) (*eventSpool, error) {
+	key, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve spool directory: %w", err)
+	}
+
+	spoolsMutex.Lock()
+	defer spoolsMutex.Unlock()
+
+	if s, ok := spools[key]; ok {
+		s.refs++
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &eventSpool{
+		dir:      key,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		refs:     1,
+	}
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments {
+		s.totalBytes += fileSize(filepath.Join(key, name))
+	}
+
+	spools[key] = s
+	return s, nil
+}
+
+// Append writes the events to the active segment. It returns the amount of events
+// that were discarded from the oldest segments to keep the spool below its size cap.
+func (s *eventSpool) Append(events []*UmamiEvent) (int, error) {
+	var buf bytes.Buffer
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return 0, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The size cap is only enforced when a new segment is started, so the spool may exceed it by up to one segment.
+	rotated := s.active == nil
+	if rotated {
+		if err := s.openSegment(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.active.Write(buf.Bytes())
+	s.activeSize += int64(n)
+	s.totalBytes += int64(n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write spool segment: %w", err)
+	}
+
+	if s.activeSize >= spoolSegmentMaxBytes {
+		s.closeSegment()
+	}
+	if !rotated {
+		return 0, nil
+	}
+	return s.enforceLimit(), nil
+}
+
+// Pending reports whether the spool contains any segments.
+func (s *eventSpool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.activeSize > 0 {
+		return true
+	}
+	segments, _ := s.segments()
+	for _, name := range segments {
+		if name != s.activeName {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain sends spooled events in order, oldest segment first, in batches of batchSize. send returns how many
+// events of the batch were delivered, e.g. the first part of a split batch, with the error of the rest.
+// It stops at the first failed batch and keeps the unsent events in place for the next drain.
+// Only one drain runs at a time, a concurrent call returns at once.
+func (s *eventSpool) Drain(batchSize int, send func([]*UmamiEvent) (int, error)) (spoolDrainResult, error) {
+	var result spoolDrainResult
+	if !s.drainBusy.CompareAndSwap(false, true) {
+		return result, nil
+	}
+	defer s.drainBusy.Store(false)
+
+	for {
+		name, err := s.nextSegment()
+		if err != nil || name == "" {
+			return result, err
+		}
+
+		err = s.drainSegment(name, batchSize, send, &result)
+
+		s.mu.Lock()
+		s.draining = ""
+		s.mu.Unlock()
+
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+// nextSegment returns the oldest segment and marks it as draining, the active segment is rotated if needed.
+func (s *eventSpool) nextSegment() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := s.segments()
+	if err != nil || len(segments) == 0 {
+		return "", err
+	}
+
+	name := segments[0]
+	if name == s.activeName {
+		if s.activeSize == 0 {
+			return "", nil
+		}
+		s.closeSegment()
+	}
+
+	s.draining = name
+	return name, nil
+}
+
+func (s *eventSpool) drainSegment(name string, batchSize int, send func([]*UmamiEvent) (int, error), result *spoolDrainResult) error {
+	segmentPath := filepath.Join(s.dir, name)
+	events, corrupt, err := readSpoolSegment(segmentPath)
+	if err != nil {
+		return err
+	}
+	result.Corrupt += corrupt
+
+	if s.maxAge > 0 {
+		minTimestamp := time.Now().Add(-s.maxAge).Unix()
+		fresh := events[:0]
+		for _, event := range events {
+			if event.Timestamp >= minTimestamp {
+				fresh = append(fresh, event)
+			}
+		}
+		result.Expired += len(events) - len(fresh)
+		events = fresh
+	}
+
+	oldSize := fileSize(segmentPath)
+	for len(events) > 0 {
+		batch := events[:min(batchSize, len(events))]
+		sent, err := send(batch)
+		result.Sent += sent
+		events = events[sent:]
+		if err != nil {
+			writeErr := s.rewriteSegment(segmentPath, events)
+			s.addBytes(fileSize(segmentPath) - oldSize)
+			if writeErr != nil {
+				return errors.Join(err, writeErr)
+			}
+			return err
+		}
+	}
+
+	if err := os.Remove(segmentPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove spool segment: %w", err)
+	}
+	s.addBytes(-oldSize)
+	return nil
+}
+
+func (s *eventSpool) addBytes(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.totalBytes = max(s.totalBytes+n, 0)
+}
+
+// fileSize returns the size of a file, 0 if it does not exist.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// rewriteSegment atomically replaces the segment with the events which were not sent yet.
+func (s *eventSpool) rewriteSegment(segmentPath string, events []*UmamiEvent) error {
+	tmpPath := segmentPath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite spool segment: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, event := range events {
+		if err = encoder.Encode(event); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to rewrite spool segment: %w", err)
+	}
+
+	return os.Rename(tmpPath, segmentPath)
+}
+
+// readSpoolSegment reads all events of a segment, lines which can't be decoded
+// (e.g. a truncated last line after a crash) are skipped and counted.
+func readSpoolSegment(segmentPath string) ([]*UmamiEvent, int, error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var events []*UmamiEvent
+	corrupt := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var event UmamiEvent
+			if len(line) > spoolMaxLineBytes || json.Unmarshal(line, &event) != nil {
+				corrupt++
+			} else {
+				events = append(events, &event)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return events, corrupt, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read spool segment: %w", err)
+		}
+	}
+}
+
+// enforceLimit removes the oldest segments until the spool is below maxBytes and returns the amount of removed events.
+// Must be called with the lock held.
+func (s *eventSpool) enforceLimit() int {
+	if s.maxBytes <= 0 || s.totalBytes <= s.maxBytes {
+		return 0
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, name := range segments {
+		if s.totalBytes <= s.maxBytes {
+			break
+		}
+		if name == s.activeName || name == s.draining {
+			continue
+		}
+
+		segmentPath := filepath.Join(s.dir, name)
+		content, err := os.ReadFile(segmentPath)
+		if err != nil || os.Remove(segmentPath) != nil {
+			continue
+		}
+		removed += bytes.Count(content, []byte{'\n'})
+		s.totalBytes = max(s.totalBytes-int64(len(content)), 0)
+	}
+
+	return removed
+}
+
+// segments returns the names of all segment files, oldest first.
+func (s *eventSpool) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, spoolSegmentPrefix) && strings.HasSuffix(name, spoolSegmentSuffix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// openSegment creates a new active segment, named after the current time so the order survives restarts.
+// Must be called with the lock held.
+func (s *eventSpool) openSegment() error {
+	seq := max(time.Now().UnixNano(), s.lastSeq+1)
+	s.lastSeq = seq
+
+	name := fmt.Sprintf("%s%020d%s", spoolSegmentPrefix, seq, spoolSegmentSuffix)
+	file, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+
+	s.active = file
+	s.activeName = name
+	s.activeSize = 0
+	return nil
+}
+
+// closeSegment closes the active segment, the next Append starts a new one.
+// Must be called with the lock held.
+func (s *eventSpool) closeSegment() {
+	if s.active != nil {
+		_ = s.active.Close()
+	}
+	s.active = nil
+	s.activeName = ""
+	s.activeSize = 0
+}
+
+// Close releases the spool, the active segment is closed once the last user released it.
+func (s *eventSpool) Close() {
+	spoolsMutex.Lock()
+	defer spoolsMutex.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	if spools[s.dir] == s {
+		delete(spools, s.dir)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeSegment()
+}
@@ -0,0 +1,228 @@
+package traefik_umami_feeder
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolDrainInOrder(t *testing.T) {
+	spool, err := newEventSpool(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 5 {
+		if _, err := spool.Append([]*UmamiEvent{{Url: "/" + string(rune('a'+i))}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !spool.Pending() {
+		t.Fatal("expected pending events")
+	}
+
+	var urls []string
+	result, err := spool.Drain(2, func(events []*UmamiEvent) (int, error) {
+		for _, event := range events {
+			urls = append(urls, event.Url)
+		}
+		return len(events), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Sent != 5 || len(urls) != 5 || urls[0] != "/a" || urls[4] != "/e" {
+		t.Fatalf("unexpected drain result %+v: %v", result, urls)
+	}
+	if spool.Pending() {
+		t.Fatal("expected empty spool")
+	}
+}
+
+func TestSpoolKeepsEventsOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := newEventSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spool.Append([]*UmamiEvent{{Url: "/a"}, {Url: "/b"}, {Url: "/c"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	result, err := spool.Drain(2, func(events []*UmamiEvent) (int, error) {
+		calls++
+		if calls == 2 {
+			return 0, errors.New("unavailable")
+		}
+		return len(events), nil
+	})
+	if err == nil || result.Sent != 2 {
+		t.Fatalf("expected failure after 2 sent events, got %+v: %v", result, err)
+	}
+	spool.Close()
+
+	// A new spool on the same directory picks up the remaining event, as after a restart.
+	spool, err = newEventSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	_, err = spool.Drain(2, func(events []*UmamiEvent) (int, error) {
+		for _, event := range events {
+			urls = append(urls, event.Url)
+		}
+		return len(events), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != "/c" {
+		t.Fatalf("expected remaining event /c, got %v", urls)
+	}
+}
+
+func TestSpoolPartialSend(t *testing.T) {
+	spool, err := newEventSpool(t.TempDir(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if _, err := spool.Append([]*UmamiEvent{{Url: "/a"}, {Url: "/b"}, {Url: "/c"}, {Url: "/d"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first half of a split batch is delivered, the drain stops and keeps the rest in place.
+	var urls []string
+	result, err := spool.Drain(3, func(events []*UmamiEvent) (int, error) {
+		urls = append(urls, events[0].Url)
+		return 1, errors.New("unavailable")
+	})
+	if err == nil || result.Sent != 1 || len(urls) != 1 {
+		t.Fatalf("expected failure after 1 sent event, got %+v: %v", result, urls)
+	}
+
+	urls = nil
+	if _, err := spool.Drain(3, func(events []*UmamiEvent) (int, error) {
+		for _, event := range events {
+			urls = append(urls, event.Url)
+		}
+		return len(events), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(urls, ",") != "/b,/c,/d" {
+		t.Fatalf("expected the remaining events in order, got %v", urls)
+	}
+}
+
+func TestSpoolTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	content := `{"website":"1","hostname":"a","url":"/a"}` + "\n" + `{"website":"1","hostn`
+	if err := os.WriteFile(filepath.Join(dir, "segment-00000000000000000001.jsonl"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := newEventSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := spool.Drain(10, func(events []*UmamiEvent) (int, error) { return len(events), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 1 || result.Corrupt != 1 {
+		t.Fatalf("expected 1 sent and 1 corrupt event, got %+v", result)
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	spool, err := newEventSpool(t.TempDir(), 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = spool.Append([]*UmamiEvent{
+		{Url: "/old", Timestamp: time.Now().Add(-2 * time.Hour).Unix()},
+		{Url: "/new", Timestamp: time.Now().Unix()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := spool.Drain(10, func(events []*UmamiEvent) (int, error) { return len(events), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 1 || result.Expired != 1 {
+		t.Fatalf("expected 1 sent and 1 expired event, got %+v", result)
+	}
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	spool, err := newEventSpool(t.TempDir(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spool.Append([]*UmamiEvent{{Url: "/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+
+	discarded, err := spool.Append([]*UmamiEvent{{Url: "/b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discarded != 1 {
+		t.Fatalf("expected 1 discarded event, got %d", discarded)
+	}
+}
+
+func TestSpoolSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	first, err := newEventSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newEventSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected the spools of one directory to be shared")
+	}
+
+	if _, err := first.Append([]*UmamiEvent{{Url: "/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Drain(10, func(events []*UmamiEvent) (int, error) { return len(events), nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Append([]*UmamiEvent{{Url: "/b"}}); err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	second.Close()
+
+	// The event appended after the drain survives a restart.
+	spool, err := newEventSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	var urls []string
+	if _, err := spool.Drain(10, func(events []*UmamiEvent) (int, error) {
+		for _, event := range events {
+			urls = append(urls, event.Url)
+		}
+		return len(events), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 || urls[0] != "/b" {
+		t.Fatalf("expected the event /b, got %v", urls)
+	}
+}
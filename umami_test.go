@@ -48,7 +48,7 @@ func TestShouldTrackDefault(t *testing.T) {
 
 func assertResource(t *testing.T, plugin *UmamiFeeder, expected bool, url string) {
 	t.Helper()
-	if expected != plugin.shouldTrackResource(url) {
+	if expected != plugin.shouldTrackResource(url, plugin.defaultOptions()) {
 		t.Fatalf("expected %v for %s", expected, url)
 	}
 }
@@ -65,7 +65,7 @@ func TestShouldTrackInvalidIp(t *testing.T) {
 }
 
 func TestShouldTrackIps(t *testing.T) {
-	feeder := &UmamiFeeder{createNewWebsites: true}
+	feeder := &UmamiFeeder{backend: &umamiBackend{}, createNewWebsites: true}
 	err := feeder.verifyConfig(&Config{
 		IgnoreIPs: []string{"127.0.0.1", "10.0.0.1/24"},
 	})
@@ -88,13 +88,13 @@ func assertIgnoreIP(t *testing.T, plugin *UmamiFeeder, expected bool, clientIP s
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost", nil)
 	req.Header.Set(plugin.headerIp, clientIP)
 
-	if expected != plugin.shouldTrackRequest(req) {
+	if expected != plugin.shouldTrackRequest(req, plugin.defaultOptions()) {
 		t.Fatalf("expected %v for %s", expected, clientIP)
 	}
 }
 
 func TestShouldTrackHosts(t *testing.T) {
-	feeder := &UmamiFeeder{createNewWebsites: true, ignoreHosts: []string{"localhost", "internal.example.com"}}
+	feeder := &UmamiFeeder{backend: &umamiBackend{}, createNewWebsites: true, ignoreHosts: []string{"localhost", "internal.example.com"}}
 
 	assertIgnoreUrl(t, feeder, false, "http://localhost/about")
 	assertIgnoreUrl(t, feeder, false, "http://LOCALHOST/about")
@@ -104,7 +104,7 @@ func TestShouldTrackHosts(t *testing.T) {
 }
 
 func TestShouldTrackUrls(t *testing.T) {
-	feeder := &UmamiFeeder{createNewWebsites: true}
+	feeder := &UmamiFeeder{backend: &umamiBackend{}, createNewWebsites: true}
 	err := feeder.verifyConfig(&Config{
 		IgnoreURLs: []string{"/about", "^/admin", "world$"},
 	})
@@ -125,13 +125,13 @@ func assertIgnoreUrl(t *testing.T, plugin *UmamiFeeder, expected bool, url strin
 	t.Helper()
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
 
-	if expected != plugin.shouldTrackRequest(req) {
+	if expected != plugin.shouldTrackRequest(req, plugin.defaultOptions()) {
 		t.Fatalf("expected %v for %s", expected, url)
 	}
 }
 
 func TestShouldTrackUserAgents(t *testing.T) {
-	feeder := &UmamiFeeder{createNewWebsites: true, ignoreUserAgents: []string{"Googlebot", "Uptime-Kuma"}}
+	feeder := &UmamiFeeder{backend: &umamiBackend{}, createNewWebsites: true, ignoreUserAgents: []string{"Googlebot", "Uptime-Kuma"}}
 
 	assertIgnoreUa(t, feeder, true, "Mozilla/5.0 (Windows; Windows NT 6.0; WOW64) Gecko/20100101 Firefox/60.7")
 	assertIgnoreUa(t, feeder, true, "Mozilla/5.0 (compatible; MSIE 10.0; Windows NT 10.0; Win64; x64 Trident/6.0)")
@@ -148,7 +148,16 @@ func assertIgnoreUa(t *testing.T, plugin *UmamiFeeder, expected bool, ua string)
 	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://localhost/", nil)
 	req.Header.Set("User-Agent", ua)
 
-	if expected != plugin.shouldTrackRequest(req) {
+	if expected != plugin.shouldTrackRequest(req, plugin.defaultOptions()) {
 		t.Fatalf("expected %v for %s", expected, ua)
 	}
 }
+
+func assertTrackHost(t *testing.T, plugin *UmamiFeeder, expected bool, url string) {
+	t.Helper()
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, url, nil)
+
+	if expected != plugin.shouldTrack(req, parseDomainFromHost(req.Host), plugin.defaultOptions()) {
+		t.Fatalf("expected %v for %s", expected, url)
+	}
+}
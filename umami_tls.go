@@ -0,0 +1,187 @@
+package traefik_umami_feeder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFiles loads the CA bundle and client certificate used to connect to Umami.
+// Files are checked on every TLS handshake and reloaded when they change,
+// so rotated certificates are picked up without a restart.
+type tlsFiles struct {
+	caFile   string
+	caPem    string
+	certFile string
+	keyFile  string
+
+	mu         sync.Mutex
+	caStamp    fileStamp
+	pool       *x509.CertPool
+	certStamps [2]fileStamp
+	cert       *tls.Certificate
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(name string) (fileStamp, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// newTLSConfig creates the TLS configuration for connections to umamiHost, nil is returned if no TLS option is set.
+func newTLSConfig(config *Config, umamiHost string) *tls.Config {
+	hasCA := config.UmamiCA != "" || config.UmamiCAPem != ""
+	hasCert := config.UmamiClientCert != "" || config.UmamiClientKey != ""
+	if !hasCA && !hasCert && config.UmamiServerName == "" && !config.UmamiInsecureSkipVerify {
+		return nil
+	}
+
+	files := &tlsFiles{
+		caFile:   config.UmamiCA,
+		caPem:    config.UmamiCAPem,
+		certFile: config.UmamiClientCert,
+		keyFile:  config.UmamiClientKey,
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.UmamiServerName,
+		InsecureSkipVerify: config.UmamiInsecureSkipVerify, //nolint:gosec // Explicit opt-in for lab clusters.
+	}
+
+	if hasCert {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return files.clientCertificate()
+		}
+	}
+
+	if hasCA && !config.UmamiInsecureSkipVerify {
+		// The default verification can't use a pool which changes over time,
+		// so it is disabled and the chain is verified against the current pool instead.
+		// The expected name is resolved here, as no SNI (and thus no cs.ServerName) is sent for IP addresses.
+		serverName := config.UmamiServerName
+		if serverName == "" {
+			if u, err := url.Parse(umamiHost); err == nil {
+				serverName = u.Hostname()
+			}
+		}
+
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			pool, err := files.rootCAs()
+			if err != nil {
+				return err
+			}
+			return verifyPeer(cs, pool, serverName)
+		}
+	}
+
+	return tlsConfig
+}
+
+// verifyPeer verifies the certificate chain and hostname presented by the server.
+func verifyPeer(cs tls.ConnectionState, pool *x509.CertPool, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("umami did not present a certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         pool,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// rootCAs returns the pool of trusted CAs, reloading the CA file if it changed.
+func (f *tlsFiles) rootCAs() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.caFile == "" {
+		if f.pool == nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(f.caPem)) {
+				return nil, errors.New("umamiCAPem contains no valid certificates")
+			}
+			f.pool = pool
+		}
+		return f.pool, nil
+	}
+
+	stamp, err := statFile(f.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read umamiCA: %w", err)
+	}
+	if f.pool != nil && stamp == f.caStamp {
+		return f.pool, nil
+	}
+
+	content, err := os.ReadFile(f.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read umamiCA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if f.caPem != "" {
+		pool.AppendCertsFromPEM([]byte(f.caPem))
+	}
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("umamiCA %s contains no valid certificates", f.caFile)
+	}
+
+	f.pool = pool
+	f.caStamp = stamp
+	return f.pool, nil
+}
+
+// clientCertificate returns the client certificate, reloading the files if any of them changed.
+func (f *tlsFiles) clientCertificate() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.certFile == "" || f.keyFile == "" {
+		return nil, errors.New("both umamiClientCert and umamiClientKey must be set")
+	}
+
+	certStamp, err := statFile(f.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read umamiClientCert: %w", err)
+	}
+	keyStamp, err := statFile(f.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read umamiClientKey: %w", err)
+	}
+
+	stamps := [2]fileStamp{certStamp, keyStamp}
+	if f.cert != nil && stamps == f.certStamps {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	f.cert = &cert
+	f.certStamps = stamps
+	return f.cert, nil
+}
@@ -0,0 +1,259 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTLSCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+
+	_, err := sendRequest(context.Background(), newHTTPClient(cfg, cfg.UmamiHost), server.URL, nil, nil)
+	if err == nil {
+		t.Fatal("expected untrusted certificate to fail")
+	}
+
+	cfg.UmamiCA = caFile
+	resp, err := sendRequest(context.Background(), newHTTPClient(cfg, cfg.UmamiHost), server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	cfg.UmamiCA = ""
+	cfg.UmamiCAPem = string(caPem)
+	resp, err = sendRequest(context.Background(), newHTTPClient(cfg, cfg.UmamiHost), server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	cfg.UmamiServerName = "umami.invalid"
+	_, err = sendRequest(context.Background(), newHTTPClient(cfg, cfg.UmamiHost), server.URL, nil, nil)
+	if err == nil {
+		t.Fatal("expected server name mismatch to fail")
+	}
+}
+
+func TestTLSInsecureSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+	cfg.UmamiInsecureSkipVerify = true
+
+	resp, err := sendRequest(context.Background(), newHTTPClient(cfg, cfg.UmamiHost), server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+}
+
+// testCert is a certificate with its key, signed by its parent or self-signed.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// writeTestFile writes the file with a new modification time, so it is detected as changed
+// even if it is rewritten within the resolution of the file system clock.
+func writeTestFile(t *testing.T, name string, content []byte, version int) {
+	t.Helper()
+	if err := os.WriteFile(name, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(version) * time.Second)
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSClientCertificate(t *testing.T) {
+	serverCA := newTestCert(t, "server-ca", nil)
+	clientCA := newTestCert(t, "client-ca", nil)
+	serverCert := newTestCert(t, "umami", serverCA)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+	cfg.UmamiCAPem = string(serverCA.certPem)
+
+	_, err := sendRequest(context.Background(), newHTTPClient(cfg, cfg.UmamiHost), server.URL, nil, nil)
+	if err == nil {
+		t.Fatal("expected the request without client certificate to fail")
+	}
+
+	dir := t.TempDir()
+	cfg.UmamiClientCert = filepath.Join(dir, "client.pem")
+	cfg.UmamiClientKey = filepath.Join(dir, "client-key.pem")
+	first := newTestCert(t, "client-1", clientCA)
+	writeTestFile(t, cfg.UmamiClientCert, first.certPem, 0)
+	writeTestFile(t, cfg.UmamiClientKey, first.keyPem, 0)
+
+	client := newHTTPClient(cfg, cfg.UmamiHost)
+	assertClientName(t, client, server.URL, "client-1")
+
+	// A rotated certificate is presented on the next connection.
+	second := newTestCert(t, "client-2", clientCA)
+	writeTestFile(t, cfg.UmamiClientCert, second.certPem, 1)
+	writeTestFile(t, cfg.UmamiClientKey, second.keyPem, 1)
+	client.CloseIdleConnections()
+	assertClientName(t, client, server.URL, "client-2")
+}
+
+func assertClientName(t *testing.T, client *http.Client, url, expected string) {
+	t.Helper()
+	resp, err := sendRequest(context.Background(), client, url, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != expected {
+		t.Fatalf("expected the client certificate %s, got %s", expected, body)
+	}
+}
+
+func TestTLSCAReload(t *testing.T) {
+	oldCA := newTestCert(t, "old-ca", nil)
+	newCA := newTestCert(t, "new-ca", nil)
+	certs := map[bool]tls.Certificate{
+		false: newTestCert(t, "umami", oldCA).tlsCertificate(),
+		true:  newTestCert(t, "umami", newCA).tlsCertificate(),
+	}
+	var rotated atomic.Bool
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{Certificates: []tls.Certificate{certs[rotated.Load()]}}, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.UmamiHost = server.URL
+	cfg.UmamiCA = filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, cfg.UmamiCA, oldCA.certPem, 0)
+	client := newHTTPClient(cfg, cfg.UmamiHost)
+
+	resp, err := sendRequest(context.Background(), client, server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	// The server moves to a certificate of the new CA, which is not trusted yet.
+	rotated.Store(true)
+	client.CloseIdleConnections()
+	if _, err := sendRequest(context.Background(), client, server.URL, nil, nil); err == nil {
+		t.Fatal("expected the certificate of the new CA to be rejected")
+	}
+
+	writeTestFile(t, cfg.UmamiCA, newCA.certPem, 1)
+	resp, err = sendRequest(context.Background(), client, server.URL, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+}
@@ -1,6 +1,12 @@
 package traefik_umami_feeder
 
-import "context"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
 
 type authRequest struct {
 	Username string `json:"username"`
@@ -11,9 +17,9 @@ type authResponse struct {
 	Token string `json:"token"`
 }
 
-func getToken(ctx context.Context, umamiHost, umamiUsername, umamiPassword string) (string, error) {
+func getToken(ctx context.Context, client *http.Client, umamiHost, umamiUsername, umamiPassword string) (string, error) {
 	var result authResponse
-	err := sendRequestAndParse(ctx, umamiHost+"/api/auth/login", authRequest{
+	err := sendRequestAndParse(ctx, client, umamiHost+"/api/auth/login", authRequest{
 		Username: umamiUsername,
 		Password: umamiPassword,
 	}, nil, &result)
@@ -23,3 +29,131 @@ func getToken(ctx context.Context, umamiHost, umamiUsername, umamiPassword strin
 
 	return result.Token, nil
 }
+
+func verifyToken(ctx context.Context, client *http.Client, umamiHost, umamiToken string) error {
+	headers := make(http.Header)
+	headers.Set("Authorization", "Bearer "+umamiToken)
+
+	resp, err := sendRequest(ctx, client, umamiHost+"/api/auth/verify", struct{}{}, headers)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// isUnauthorized reports whether Umami rejected the token of a request.
+func isUnauthorized(err error) bool {
+	var reqErr *requestError
+	return errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusUnauthorized
+}
+
+func (b *umamiBackend) token() string {
+	b.tokenMutex.RLock()
+	defer b.tokenMutex.RUnlock()
+
+	return b.umamiToken
+}
+
+// canLogin reports whether credentials are configured, so a new token can be retrieved.
+func (b *umamiBackend) canLogin() bool {
+	return b.umamiUsername != "" && (b.umamiPasswordValue != "" || b.umamiPasswordFile != "")
+}
+
+// canRefresh reports whether a rejected token can be replaced, by logging in or by re-reading the token file.
+func (b *umamiBackend) canRefresh() bool {
+	return b.canLogin() || b.umamiTokenFile != ""
+}
+
+// login retrieves a new token using the configured credentials and stores it.
+// The password is resolved on every login, so a rotated password file takes effect.
+func (b *umamiBackend) login(ctx context.Context) (string, error) {
+	password, err := b.loadPassword()
+	if err != nil {
+		return "", err
+	}
+
+	var token string
+	err = b.callEndpoints(func(ep *umamiEndpoint) error {
+		token, err = getToken(ctx, ep.client, ep.url, b.umamiUsername, password)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get token: %w", err)
+	}
+	if token == "" {
+		return "", errors.New("retrieved token is empty")
+	}
+
+	b.tokenMutex.Lock()
+	b.umamiToken = token
+	b.tokenMutex.Unlock()
+	return token, nil
+}
+
+// refreshToken logs in again, unless a concurrent caller has already replaced the stale token,
+// so that only one login request is made at a time.
+func (b *umamiBackend) refreshToken(ctx context.Context, staleToken string) (string, error) {
+	b.loginMutex.Lock()
+	defer b.loginMutex.Unlock()
+
+	if token := b.token(); token != staleToken {
+		return token, nil
+	}
+
+	if !b.canLogin() {
+		b.debugf("token rejected, reading token file again")
+		if err := b.loadToken(); err != nil {
+			return "", err
+		}
+		return b.token(), nil
+	}
+
+	b.debugf("token rejected, logging in again")
+	return b.login(ctx)
+}
+
+// withToken calls fn with the current token. If Umami responds with 401 and the token can be refreshed,
+// fn is retried once with the new token.
+func (b *umamiBackend) withToken(ctx context.Context, fn func(token string) error) error {
+	token := b.token()
+	err := fn(token)
+	if err == nil || !isUnauthorized(err) || !b.canRefresh() {
+		return err
+	}
+
+	token, err = b.refreshToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+// startTokenVerifier periodically verifies the token and refreshes it when it was revoked or has expired.
+func (b *umamiBackend) startTokenVerifier(ctx context.Context) {
+	ticker := time.NewTicker(b.tokenVerifyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			token := b.token()
+			err := b.callEndpoints(func(ep *umamiEndpoint) error {
+				return verifyToken(ctx, ep.client, ep.url, token)
+			})
+			if err == nil {
+				b.debugf("token verified")
+				continue
+			}
+			if !isUnauthorized(err) {
+				b.error("failed to verify token: " + err.Error())
+				continue
+			}
+
+			if _, err := b.refreshToken(ctx, token); err != nil {
+				b.error("failed to refresh token: " + err.Error())
+			}
+		}
+	}
+}
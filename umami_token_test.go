@@ -0,0 +1,75 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWithTokenRelogin(t *testing.T) {
+	var logins atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/auth/login":
+			n := logins.Add(1)
+			_, _ = fmt.Fprintf(rw, `{"token":"token-%d"}`, n)
+		case "/api/websites":
+			if req.Header.Get("Authorization") != "Bearer token-1" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = rw.Write([]byte(`{"data":[]}`))
+		}
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		endpoints:          testEndpoints(server),
+		umamiToken:         "expired",
+		umamiUsername:      "admin",
+		umamiPasswordValue: "umami",
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := backend.withToken(context.Background(), func(token string) error {
+				_, err := fetchWebsites(context.Background(), backend.endpoints[0].client, backend.endpoints[0].url, token, "")
+				return err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins.Load() != 1 {
+		t.Fatalf("expected a single login, got %d", logins.Load())
+	}
+	if backend.token() != "token-1" {
+		t.Fatalf("expected refreshed token, got %s", backend.token())
+	}
+}
+
+func TestWithTokenWithoutCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{endpoints: testEndpoints(server), umamiToken: "api-key"}
+	err := backend.withToken(context.Background(), func(token string) error {
+		_, err := fetchWebsites(context.Background(), backend.endpoints[0].client, backend.endpoints[0].url, token, "")
+		return err
+	})
+	if !isUnauthorized(err) {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+}
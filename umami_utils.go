@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"regexp"
@@ -13,7 +15,7 @@ import (
 	"time"
 )
 
-func sendRequest(ctx context.Context, url string, body any, headers http.Header) (*http.Response, error) {
+func sendRequest(ctx context.Context, client *http.Client, url string, body any, headers http.Header) (*http.Response, error) {
 	var req *http.Request
 	var err error
 
@@ -22,6 +24,12 @@ func sendRequest(ctx context.Context, url string, body any, headers http.Header)
 		if err2 != nil {
 			return nil, err2
 		}
+		if headers.Get("Content-Encoding") == CompressionGzip {
+			bodyJson, err2 = gzipBody(bodyJson)
+			if err2 != nil {
+				return nil, err2
+			}
+		}
 
 		req, err = http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(bodyJson))
 	} else {
@@ -40,7 +48,6 @@ func sendRequest(ctx context.Context, url string, body any, headers http.Header)
 		req.Header.Set("Content-Type", "application/json")
 	}
 
-	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -54,16 +61,62 @@ func sendRequest(ctx context.Context, url string, body any, headers http.Header)
 
 		respBody, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("request failed with status %d (failed to read body: %w)", status, err)
+			return nil, &requestError{StatusCode: status, Body: "failed to read body: " + err.Error()}
 		}
-		return nil, fmt.Errorf("request failed with status %d (%v)", status, string(respBody))
+		return nil, &requestError{StatusCode: status, Body: string(respBody)}
 	}
 
 	return resp, nil
 }
 
-func sendRequestAndParse(ctx context.Context, url string, body any, headers http.Header, value any) error {
-	resp, err := sendRequest(ctx, url, body, headers)
+// requestError is returned by sendRequest when Umami responds with a non-2xx status code.
+type requestError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("request failed with status %d (%v)", e.StatusCode, e.Body)
+}
+
+// isRetryableError reports whether a failed request may succeed when repeated.
+// Network errors, 408, 429 and 5xx responses are retryable, other statuses (400, 401, 404, ...) are permanent.
+func isRetryableError(err error) bool {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		return !errors.Is(err, context.Canceled)
+	}
+
+	switch {
+	case reqErr.StatusCode == http.StatusRequestTimeout, reqErr.StatusCode == http.StatusTooManyRequests:
+		return true
+	case reqErr.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// backoffDelay returns the jittered delay before the given retry attempt (starting at 0).
+// The delay doubles on every attempt up to maxInterval, a random jitter of up to half the delay is subtracted.
+func backoffDelay(attempt int, initialInterval, maxInterval time.Duration) time.Duration {
+	delay := initialInterval
+	for i := 0; i < attempt && delay < maxInterval; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxInterval)
+	if delay <= 0 {
+		return 0
+	}
+
+	half := int64(delay / 2)
+	if half == 0 {
+		return delay
+	}
+	return delay - time.Duration(rand.Int63n(half))
+}
+
+func sendRequestAndParse(ctx context.Context, client *http.Client, url string, body any, headers http.Header, value any) error {
+	resp, err := sendRequest(ctx, client, url, body, headers)
 	if err != nil {
 		return err
 	}
@@ -84,13 +137,16 @@ func sendRequestAndParse(ctx context.Context, url string, body any, headers http
 	return nil
 }
 
+// parseDomainFromHost normalizes a Host header: the port and the brackets of IPv6 literals are removed,
+// as well as a trailing dot, and internationalized names are lowercased and converted to their ASCII form.
 func parseDomainFromHost(host string) string {
-	// check if the host has a port
-	if strings.Contains(host, ":") {
-		host = strings.Split(host, ":")[0]
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
 	}
 	host = strings.TrimSuffix(host, ".")
-	return strings.ToLower(host)
+	return hostnameToASCII(strings.ToLower(host))
 }
 
 const parseAcceptLanguagePattern = `([a-zA-Z\-]+)(?:;q=\d\.\d)?(?:,\s)?`
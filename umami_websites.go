@@ -2,7 +2,11 @@ package traefik_umami_feeder
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,13 +26,13 @@ type Website struct {
 	CreatedAt time.Time `json:"createdAt,omitempty"`
 }
 
-func createWebsite(ctx context.Context, umamiHost, umamiToken, teamId, websiteDomain string) (*Website, error) {
+func createWebsite(ctx context.Context, client *http.Client, umamiHost, umamiToken, teamId, websiteDomain, websiteName string) (*Website, error) {
 	headers := make(http.Header)
 	headers.Set("Authorization", "Bearer "+umamiToken)
 
 	var result Website
-	err := sendRequestAndParse(ctx, umamiHost+"/api/websites", Website{
-		Name:   websiteDomain,
+	err := sendRequestAndParse(ctx, client, umamiHost+"/api/websites", Website{
+		Name:   websiteName,
 		Domain: websiteDomain,
 		TeamId: teamId,
 	}, headers, &result)
@@ -39,52 +43,358 @@ func createWebsite(ctx context.Context, umamiHost, umamiToken, teamId, websiteDo
 	return &result, nil
 }
 
-func fetchWebsites(ctx context.Context, umamiHost, umamiToken, teamId string) (*[]Website, error) {
+const (
+	websitesPageSize = 200
+	// websitesMaxPages is a safety cap for the pagination, in case Umami reports an inconsistent count.
+	websitesMaxPages = 100
+)
+
+func fetchWebsites(ctx context.Context, client *http.Client, umamiHost, umamiToken, teamId string) (*[]Website, error) {
 	headers := make(http.Header)
 	headers.Set("Authorization", "Bearer "+umamiToken)
 
-	url := umamiHost + "/api/websites?pageSize=200"
+	baseUrl := umamiHost + "/api/websites"
 	if len(teamId) != 0 {
-		url = umamiHost + "/api/teams/" + teamId + "/websites?pageSize=200"
+		baseUrl = umamiHost + "/api/teams/" + teamId + "/websites"
+	}
+
+	var websites []Website
+	for page := 1; page <= websitesMaxPages; page++ {
+		url := fmt.Sprintf("%s?page=%d&pageSize=%d", baseUrl, page, websitesPageSize)
+
+		var result websitesResponse
+		err := sendRequestAndParse(ctx, client, url, nil, headers, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		websites = append(websites, result.Data...)
+		if len(result.Data) == 0 || len(websites) >= result.Count {
+			return &websites, nil
+		}
 	}
 
-	var result websitesResponse
-	err := sendRequestAndParse(ctx, url, nil, headers, &result)
+	return nil, fmt.Errorf("more than %d pages of websites", websitesMaxPages)
+}
+
+// refreshWebsites fetches the websites from the API and merges them into the known websites.
+// The websites are keyed by their normalized domain, each instance canonicalizes them for its lookups.
+func (b *umamiBackend) refreshWebsites(ctx context.Context) error {
+	var websites *[]Website
+	err := b.withToken(ctx, func(token string) error {
+		return b.callEndpoints(func(ep *umamiEndpoint) error {
+			var err error
+			websites, err = fetchWebsites(ctx, ep.client, ep.url, token, b.umamiTeamId)
+			return err
+		})
+	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to fetch websites: %w", err)
 	}
 
-	return &result.Data, nil
+	var added, changed, removed []string
+	fetched := make(map[string]bool, len(*websites))
+
+	b.websitesMutex.Lock()
+	for _, website := range *websites {
+		domain := parseDomainFromHost(website.Domain)
+		fetched[domain] = true
+
+		websiteId, ok := b.websites[domain]
+		if !ok {
+			added = append(added, domain)
+		} else if websiteId != website.ID {
+			changed = append(changed, domain)
+		}
+		b.websites[domain] = website.ID
+	}
+	if b.removeDeletedWebsites {
+		for domain := range b.websites {
+			if !fetched[domain] {
+				removed = append(removed, domain)
+				delete(b.websites, domain)
+			}
+		}
+	}
+	if len(added) > 0 || len(changed) > 0 || len(removed) > 0 {
+		b.websitesVersion.Add(1)
+	}
+	total := len(b.websites)
+	b.websitesMutex.Unlock()
+
+	if len(added) > 0 || len(changed) > 0 || len(removed) > 0 {
+		slices.Sort(added)
+		slices.Sort(changed)
+		slices.Sort(removed)
+		b.debugf("websites refreshed, %d tracked: added %v, changed %v, removed %v", total, added, changed, removed)
+	}
+	return nil
 }
 
-func getWebsiteId(h *UmamiFeeder, hostname string) string {
-	h.websitesMutex.RLock()
-	websiteId, ok := h.websites[hostname]
-	h.websitesMutex.RUnlock()
+// startWebsitesRefresher periodically refreshes the websites, so websites added in Umami are picked up.
+func (b *umamiBackend) startWebsitesRefresher(ctx context.Context) {
+	ticker := time.NewTicker(b.websitesRefreshInterval)
+	defer ticker.Stop()
 
-	if ok {
-		return websiteId
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.refreshWebsites(ctx); err != nil {
+				b.error(err.Error())
+			}
+		}
 	}
+}
 
-	h.websitesMutex.Lock()
-	defer h.websitesMutex.Unlock()
+const (
+	// maxParkedEvents defines how many events are kept per host while its website is being created.
+	maxParkedEvents = 100
+	// createWebsiteTimeout bounds the creation of a website, including the login if the token expired.
+	createWebsiteTimeout = 10 * time.Second
+	// maxFailedWebsites caps the hosts whose failed website creation is tracked, as hosts are chosen by clients.
+	maxFailedWebsites = 1000
+)
 
-	// Double-check after acquiring write lock to prevent race condition
-	if websiteId, ok := h.websites[hostname]; ok {
-		return websiteId
+var (
+	// createdWebsites counts the websites created or being created by all instances, so createNewWebsitesLimit
+	// applies to the process rather than to each router. It is guarded by createdWebsitesMutex.
+	createdWebsites      int
+	createLimitLogged    bool
+	createdWebsitesMutex sync.Mutex
+)
+
+// pendingWebsite holds the events of a host whose website is being created.
+type pendingWebsite struct {
+	events  []*UmamiEvent
+	dropped int
+}
+
+// websiteFailure tracks failed website creations of a host, to back off before the next attempt.
+type websiteFailure struct {
+	attempts int
+	failedAt time.Time
+	retryAt  time.Time
+	logged   bool
+}
+
+// websiteIndex is the view of an instance on the websites known to the backend, keyed by canonical host.
+type websiteIndex struct {
+	version  int64
+	websites map[string]string
+}
+
+// getWebsiteId returns the website of the hostname, matching exact domains first, then wildcard and regexp keys.
+// Statically configured websites take precedence over fetched ones.
+func (h *UmamiFeeder) getWebsiteId(hostname string) (string, bool) {
+	rules := h.rules()
+	if websiteId, ok := rules.staticWebsites[hostname]; ok {
+		return websiteId, true
+	}
+	if websiteId, ok := h.knownWebsites()[hostname]; ok {
+		return websiteId, true
+	}
+
+	for _, p := range rules.websitePatterns {
+		if p.Match(hostname) {
+			return p.websiteId, true
+		}
 	}
+	return "", false
+}
+
+// knownWebsites returns the websites fetched or created by the backend, keyed by the canonical hosts of this instance.
+// The index is only rebuilt when the websites of the backend changed.
+func (h *UmamiFeeder) knownWebsites() map[string]string {
+	b := h.backend
+	if index, ok := h.websiteIndex.Load().(*websiteIndex); ok && index.version == b.websitesVersion.Load() {
+		return index.websites
+	}
+
+	b.websitesMutex.RLock()
+	index := &websiteIndex{
+		version:  b.websitesVersion.Load(),
+		websites: make(map[string]string, len(b.websites)),
+	}
+	for domain, websiteId := range b.websites {
+		hostname := h.hosts.canonical(domain)
+		// When several domains have the same canonical host, the domain equal to it wins.
+		if _, ok := index.websites[hostname]; ok && hostname != domain {
+			continue
+		}
+		index.websites[hostname] = websiteId
+	}
+	b.websitesMutex.RUnlock()
+
+	h.websiteIndex.Store(index)
+	return index.websites
+}
 
-	// Create a background context for the API call
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// parkEvent keeps the event until the website of its host is created. The creation is started
+// in the background for the first event of a host, so the request path is never blocked by it.
+// Events of all instances sharing the backend are parked together, so a website is only created once.
+func (h *UmamiFeeder) parkEvent(hostname string, event *UmamiEvent) {
+	b := h.backend
+	b.pendingMutex.Lock()
+	defer b.pendingMutex.Unlock()
+
+	// The website might have been created since the caller looked it up.
+	if websiteId, ok := h.getWebsiteId(hostname); ok {
+		event.Website = websiteId
+		b.enqueue(event)
+		return
+	}
+
+	pending, ok := b.pendingWebsites[hostname]
+	if !ok {
+		if failure, ok := b.failedWebsites[hostname]; ok && time.Now().Before(failure.retryAt) {
+			if !failure.logged {
+				failure.logged = true
+				h.debugf("skipping website creation for %s after %d failed attempts, backing off until %s",
+					hostname, failure.attempts, failure.retryAt.Format(time.RFC3339))
+			}
+			return
+		}
+
+		if !h.reserveWebsiteCreation(hostname) {
+			return
+		}
+
+		pending = &pendingWebsite{}
+		b.pendingWebsites[hostname] = pending
+		go h.createWebsiteInBackground(hostname)
+	}
+
+	if len(pending.events) >= maxParkedEvents {
+		pending.dropped++
+		return
+	}
+	pending.events = append(pending.events, event)
+}
+
+// createWebsiteInBackground creates the website of a host and releases its parked events.
+// The creation is canceled when the backend is stopped.
+func (h *UmamiFeeder) createWebsiteInBackground(hostname string) {
+	b := h.backend
+	ctx, cancel := context.WithTimeout(b.ctx, createWebsiteTimeout)
+	websiteId, err := h.createWebsiteForHost(ctx, hostname)
+	cancel()
+
+	b.pendingMutex.Lock()
+	pending := b.pendingWebsites[hostname]
+	delete(b.pendingWebsites, hostname)
+	if err == nil {
+		b.websitesMutex.Lock()
+		b.websites[hostname] = websiteId
+		b.websitesVersion.Add(1)
+		b.websitesMutex.Unlock()
+		delete(b.failedWebsites, hostname)
+	} else {
+		failure, ok := b.failedWebsites[hostname]
+		if !ok {
+			failure = &websiteFailure{}
+			b.failedWebsites[hostname] = failure
+		}
+		failure.failedAt = time.Now()
+		failure.retryAt = failure.failedAt.Add(backoffDelay(failure.attempts, b.createWebsiteBackoff, b.createWebsiteMaxBackoff))
+		failure.attempts++
+		failure.logged = false
+		b.pruneFailedWebsites(failure.failedAt)
+		releaseWebsiteCreation()
+	}
+	b.pendingMutex.Unlock()
+
+	if err != nil {
+		dropped := len(pending.events) + pending.dropped
+		lostEvents := b.lostEvents.Add(int64(dropped))
+		h.error(fmt.Sprintf("failed to create website %s, dropped %d events, lost so far: %d events: %s", hostname, dropped, lostEvents, err.Error()))
+		return
+	}
+
+	if pending.dropped > 0 {
+		lostEvents := b.lostEvents.Add(int64(pending.dropped))
+		h.error(fmt.Sprintf("dropped %d events while creating website %s, lost so far: %d events", pending.dropped, hostname, lostEvents))
+	}
+	for _, event := range pending.events {
+		event.Website = websiteId
+		b.enqueue(event)
+	}
+}
+
+// reserveWebsiteCreation counts a website creation against the limit, it reports false once the limit is reached.
+func (h *UmamiFeeder) reserveWebsiteCreation(hostname string) bool {
+	createdWebsitesMutex.Lock()
+	defer createdWebsitesMutex.Unlock()
+
+	if h.createNewWebsitesLimit > 0 && createdWebsites >= h.createNewWebsitesLimit {
+		if !createLimitLogged {
+			createLimitLogged = true
+			h.error(fmt.Sprintf("limit of %d created websites reached, not creating website for %s", h.createNewWebsitesLimit, hostname))
+		}
+		return false
+	}
+	createdWebsites++
+	return true
+}
+
+// releaseWebsiteCreation returns the reservation of a failed website creation.
+func releaseWebsiteCreation() {
+	createdWebsitesMutex.Lock()
+	defer createdWebsitesMutex.Unlock()
+
+	createdWebsites--
+}
+
+// pruneFailedWebsites forgets the failures of hosts which were not retried for longer than createWebsiteMaxBackoff
+// after their backoff elapsed. Hosts requested less often than their backoff keep it, so it still grows.
+// Beyond maxFailedWebsites, the oldest failures are evicted. Must be called with the pendingMutex held.
+func (b *umamiBackend) pruneFailedWebsites(now time.Time) {
+	for hostname, failure := range b.failedWebsites {
+		if _, pending := b.pendingWebsites[hostname]; !pending && now.After(failure.retryAt.Add(b.createWebsiteMaxBackoff)) {
+			delete(b.failedWebsites, hostname)
+		}
+	}
+
+	for len(b.failedWebsites) > maxFailedWebsites {
+		var oldest string
+		for hostname, failure := range b.failedWebsites {
+			if oldest == "" || failure.failedAt.Before(b.failedWebsites[oldest].failedAt) {
+				oldest = hostname
+			}
+		}
+		delete(b.failedWebsites, oldest)
+	}
+}
+
+// isCreateWebsiteAllowed reports whether a website may be created for the hostname.
+func (h *UmamiFeeder) isCreateWebsiteAllowed(hostname string) bool {
+	allow := h.rules().createNewWebsitesAllow
+	return len(allow) == 0 || matchAnyHostPattern(allow, hostname)
+}
+
+// websiteName returns the name of a website created for the hostname.
+func (h *UmamiFeeder) websiteName(hostname string) string {
+	if h.createNewWebsitesName == "" {
+		return hostname
+	}
+	return strings.NewReplacer("{{host}}", hostname, "{{middleware}}", h.name).Replace(h.createNewWebsitesName)
+}
 
-	website, err := createWebsite(ctx, h.umamiHost, h.umamiToken, h.umamiTeamId, hostname)
+func (h *UmamiFeeder) createWebsiteForHost(ctx context.Context, hostname string) (string, error) {
+	b := h.backend
+	var website *Website
+	err := b.withToken(ctx, func(token string) error {
+		return b.callEndpoints(func(ep *umamiEndpoint) error {
+			var err error
+			website, err = createWebsite(ctx, ep.client, ep.url, token, b.umamiTeamId, hostname, h.websiteName(hostname))
+			return err
+		})
+	})
 	if err != nil {
-		h.error("failed to create website: " + err.Error())
-		return ""
+		return "", err
 	}
 
-	h.websites[website.Domain] = website.ID
 	h.debugf("website created '%s': %s", website.Domain, website.ID)
-	return website.ID
+	return website.ID, nil
 }
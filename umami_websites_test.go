@@ -0,0 +1,342 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshWebsites(t *testing.T) {
+	var response atomic.Value
+	response.Store(`{"data":[{"id":"1","domain":"a.example.com"},{"id":"2","domain":"b.example.com"}]}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(response.Load().(string)))
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		endpoints:             testEndpoints(server),
+		umamiToken:            "token",
+		websites:              map[string]string{},
+		removeDeletedWebsites: true,
+	}
+
+	if err := backend.refreshWebsites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertWebsites(t, backend, map[string]string{"a.example.com": "1", "b.example.com": "2"})
+
+	// Statically configured websites take precedence over fetched ones.
+	feeder := &UmamiFeeder{backend: backend}
+	if err := feeder.verifyConfig(&Config{Websites: map[string]string{"b.example.com": "static"}}); err != nil {
+		t.Fatal(err)
+	}
+	assertWebsiteId(t, feeder, "b.example.com", "static")
+	assertWebsiteId(t, feeder, "a.example.com", "1")
+
+	response.Store(`{"data":[{"id":"3","domain":"c.example.com"}]}`)
+	if err := backend.refreshWebsites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertWebsites(t, backend, map[string]string{"c.example.com": "3"})
+	assertWebsiteId(t, feeder, "c.example.com", "3")
+
+	backend.removeDeletedWebsites = false
+	response.Store(`{"data":[]}`)
+	if err := backend.refreshWebsites(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertWebsites(t, backend, map[string]string{"c.example.com": "3"})
+}
+
+func assertWebsites(t *testing.T, backend *umamiBackend, expected map[string]string) {
+	t.Helper()
+	backend.websitesMutex.RLock()
+	defer backend.websitesMutex.RUnlock()
+
+	if len(backend.websites) != len(expected) {
+		t.Fatalf("expected websites %v, got %v", expected, backend.websites)
+	}
+	for domain, websiteId := range expected {
+		if backend.websites[domain] != websiteId {
+			t.Fatalf("expected websites %v, got %v", expected, backend.websites)
+		}
+	}
+}
+
+func TestFetchWebsitesPaginated(t *testing.T) {
+	const total = 450
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if req.URL.Path != "/api/teams/team/websites" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		pageSize, _ := strconv.Atoi(req.URL.Query().Get("pageSize"))
+		pageSize = min(pageSize, 100) // Umami may cap the page size below the requested one.
+
+		result := websitesResponse{Count: total, Page: page, PageSize: pageSize}
+		for i := (page - 1) * pageSize; i < min(page*pageSize, total); i++ {
+			result.Data = append(result.Data, Website{ID: strconv.Itoa(i), Domain: fmt.Sprintf("site%d.example.com", i)})
+		}
+		_ = json.NewEncoder(rw).Encode(result)
+	}))
+	defer server.Close()
+
+	websites, err := fetchWebsites(context.Background(), server.Client(), server.URL, "token", "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*websites) != total {
+		t.Fatalf("expected %d websites, got %d", total, len(*websites))
+	}
+	if requests.Load() != 5 {
+		t.Fatalf("expected 5 requests, got %d", requests.Load())
+	}
+}
+
+func TestFetchWebsitesPageCap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// A broken count never lets the pagination finish.
+		_, _ = rw.Write([]byte(`{"data":[{"id":"1","domain":"example.com"}],"count":1000000}`))
+	}))
+	defer server.Close()
+
+	if _, err := fetchWebsites(context.Background(), server.Client(), server.URL, "token", ""); err == nil {
+		t.Fatal("expected the page cap to be reached")
+	}
+}
+
+func TestCreateWebsiteInBackground(t *testing.T) {
+	var creates atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		creates.Add(1)
+		<-release
+		_, _ = rw.Write([]byte(`{"id":"new-id","domain":"new.example.com"}`))
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		ctx:             context.Background(),
+		endpoints:       testEndpoints(server),
+		umamiToken:      "token",
+		queue:           make(chan *UmamiEvent, 10),
+		websites:        map[string]string{},
+		pendingWebsites: map[string]*pendingWebsite{},
+		failedWebsites:  map[string]*websiteFailure{},
+	}
+	feeder := &UmamiFeeder{backend: backend, createNewWebsites: true}
+
+	// Requests are not blocked while the website is being created.
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "http://new.example.com/", nil)
+		feeder.submitToFeed(req, http.StatusOK, feeder.defaultOptions())
+	}
+	if len(backend.queue) != 0 {
+		t.Fatalf("expected events to be parked, got %d queued", len(backend.queue))
+	}
+
+	close(release)
+	for range 3 {
+		if event := <-backend.queue; event.Website != "new-id" {
+			t.Fatalf("expected released event with website new-id, got %q", event.Website)
+		}
+	}
+	if creates.Load() != 1 {
+		t.Fatalf("expected a single create request, got %d", creates.Load())
+	}
+}
+
+func TestCreateWebsiteBackoff(t *testing.T) {
+	var creates atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		creates.Add(1)
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		ctx:                     context.Background(),
+		endpoints:               testEndpoints(server),
+		umamiToken:              "token",
+		queue:                   make(chan *UmamiEvent, 10),
+		createWebsiteBackoff:    time.Hour,
+		createWebsiteMaxBackoff: time.Hour,
+		websites:                map[string]string{},
+		pendingWebsites:         map[string]*pendingWebsite{},
+		failedWebsites:          map[string]*websiteFailure{},
+	}
+	feeder := &UmamiFeeder{backend: backend}
+
+	feeder.parkEvent("denied.example.com", &UmamiEvent{})
+	waitForPendingWebsites(t, feeder)
+
+	// Further events for the host are skipped while backing off.
+	for range 5 {
+		feeder.parkEvent("denied.example.com", &UmamiEvent{})
+	}
+	waitForPendingWebsites(t, feeder)
+	if creates.Load() != 1 {
+		t.Fatalf("expected a single create request, got %d", creates.Load())
+	}
+
+	// Once the backoff elapsed, creation is attempted again.
+	feeder.backend.pendingMutex.Lock()
+	feeder.backend.failedWebsites["denied.example.com"].retryAt = time.Now()
+	feeder.backend.pendingMutex.Unlock()
+
+	feeder.parkEvent("denied.example.com", &UmamiEvent{})
+	waitForPendingWebsites(t, feeder)
+	if creates.Load() != 2 {
+		t.Fatalf("expected a second create request, got %d", creates.Load())
+	}
+	if attempts := feeder.backend.failedWebsites["denied.example.com"].attempts; attempts != 2 {
+		t.Fatalf("expected 2 failed attempts, got %d", attempts)
+	}
+}
+
+func TestPruneFailedWebsites(t *testing.T) {
+	now := time.Now()
+	backend := &umamiBackend{
+		createWebsiteMaxBackoff: time.Hour,
+		pendingWebsites:         map[string]*pendingWebsite{"retrying.example.com": {}},
+		failedWebsites: map[string]*websiteFailure{
+			"idle.example.com":     {failedAt: now.Add(-3 * time.Hour), retryAt: now.Add(-2 * time.Hour)},
+			"retrying.example.com": {failedAt: now.Add(-3 * time.Hour), retryAt: now.Add(-2 * time.Hour)},
+			"elapsed.example.com":  {failedAt: now.Add(-2 * time.Minute), retryAt: now.Add(-time.Minute)},
+			"backoff.example.com":  {failedAt: now.Add(-2 * time.Minute), retryAt: now.Add(time.Minute)},
+		},
+	}
+
+	backend.pruneFailedWebsites(now)
+	if _, ok := backend.failedWebsites["idle.example.com"]; ok {
+		t.Fatal("expected the failure of the idle host to be pruned")
+	}
+	if len(backend.failedWebsites) != 3 {
+		t.Fatalf("expected the failures of the other hosts to be kept, got %d", len(backend.failedWebsites))
+	}
+
+	// Beyond the cap, the oldest failures are evicted.
+	for i := range maxFailedWebsites {
+		backend.failedWebsites[fmt.Sprintf("%d.example.com", i)] = &websiteFailure{failedAt: now.Add(time.Duration(i) * time.Millisecond), retryAt: now.Add(time.Hour)}
+	}
+	backend.pruneFailedWebsites(now)
+	if len(backend.failedWebsites) != maxFailedWebsites {
+		t.Fatalf("expected %d failures, got %d", maxFailedWebsites, len(backend.failedWebsites))
+	}
+	for _, hostname := range []string{"retrying.example.com", "elapsed.example.com", "backoff.example.com"} {
+		if _, ok := backend.failedWebsites[hostname]; ok {
+			t.Fatalf("expected the oldest failure of %s to be evicted", hostname)
+		}
+	}
+}
+
+func TestCreateWebsiteBackoffGrows(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		ctx:                     context.Background(),
+		endpoints:               testEndpoints(server),
+		umamiToken:              "token",
+		queue:                   make(chan *UmamiEvent, 10),
+		createWebsiteBackoff:    time.Minute,
+		createWebsiteMaxBackoff: time.Hour,
+		websites:                map[string]string{},
+		pendingWebsites:         map[string]*pendingWebsite{},
+		failedWebsites:          map[string]*websiteFailure{},
+	}
+	feeder := &UmamiFeeder{backend: backend}
+
+	feeder.parkEvent("rare.example.com", &UmamiEvent{})
+	waitForPendingWebsites(t, feeder)
+
+	// The backoff of the host elapsed, but it is not requested again before another host fails.
+	backend.pendingMutex.Lock()
+	backend.failedWebsites["rare.example.com"].retryAt = time.Now().Add(-time.Second)
+	backend.pendingMutex.Unlock()
+	feeder.parkEvent("other.example.com", &UmamiEvent{})
+	waitForPendingWebsites(t, feeder)
+
+	feeder.parkEvent("rare.example.com", &UmamiEvent{})
+	waitForPendingWebsites(t, feeder)
+
+	failure := backend.failedWebsites["rare.example.com"]
+	if failure.attempts != 2 || failure.retryAt.Sub(failure.failedAt) <= time.Minute {
+		t.Fatalf("expected the backoff to double after 2 attempts, got %v after %d attempts",
+			failure.retryAt.Sub(failure.failedAt), failure.attempts)
+	}
+}
+
+func waitForPendingWebsites(t *testing.T, feeder *UmamiFeeder) {
+	t.Helper()
+	for range 100 {
+		feeder.backend.pendingMutex.Lock()
+		pending := len(feeder.backend.pendingWebsites)
+		feeder.backend.pendingMutex.Unlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("website creation did not finish")
+}
+
+func TestCreateWebsiteLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var website Website
+		_ = json.NewDecoder(req.Body).Decode(&website)
+		website.ID = website.Domain
+		_ = json.NewEncoder(rw).Encode(website)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		ctx:             context.Background(),
+		endpoints:       testEndpoints(server),
+		umamiToken:      "token",
+		queue:           make(chan *UmamiEvent, 10),
+		websites:        map[string]string{},
+		pendingWebsites: map[string]*pendingWebsite{},
+		failedWebsites:  map[string]*websiteFailure{},
+	}
+	resetCreatedWebsites(t)
+	feeder := &UmamiFeeder{backend: backend, createNewWebsitesLimit: 2}
+
+	for _, hostname := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		feeder.parkEvent(hostname, &UmamiEvent{})
+		waitForPendingWebsites(t, feeder)
+	}
+
+	assertWebsites(t, backend, map[string]string{"a.example.com": "a.example.com", "b.example.com": "b.example.com"})
+
+	// The limit applies to all instances, not to each of them.
+	other := &UmamiFeeder{backend: backend, createNewWebsitesLimit: 2}
+	other.parkEvent("d.example.com", &UmamiEvent{})
+	waitForPendingWebsites(t, other)
+
+	assertWebsites(t, backend, map[string]string{"a.example.com": "a.example.com", "b.example.com": "b.example.com"})
+}
+
+// resetCreatedWebsites starts counting the created websites from zero, as other tests create websites too.
+func resetCreatedWebsites(t *testing.T) {
+	t.Helper()
+	createdWebsitesMutex.Lock()
+	defer createdWebsitesMutex.Unlock()
+
+	createdWebsites = 0
+	createLimitLogged = false
+}
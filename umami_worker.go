@@ -28,11 +28,11 @@ type SendBody struct {
 	Type    string      `json:"type"`
 }
 
-func (h *UmamiFeeder) submitToFeed(req *http.Request, statusCode int) {
-	hostname := parseDomainFromHost(req.Host)
-	websiteId := getWebsiteId(h, hostname)
+func (h *UmamiFeeder) submitToFeed(req *http.Request, statusCode int, options *trackOptions) {
+	hostname := h.hosts.canonical(req.Host)
+	websiteId, eventUrl, ok := h.resolveWebsite(hostname, req.URL)
 
-	if websiteId == "" {
+	if !ok && !h.createNewWebsites {
 		h.error("tracking skipped, websiteId is unknown: " + hostname)
 		return
 	}
@@ -41,7 +41,7 @@ func (h *UmamiFeeder) submitToFeed(req *http.Request, statusCode int) {
 		Hostname:  hostname,
 		Language:  parseAcceptLanguage(req.Header.Get("Accept-Language")),
 		Referrer:  req.Referer(),
-		Url:       req.URL.String(),
+		Url:       eventUrl,
 		Ip:        extractRemoteIP(req),
 		UserAgent: req.Header.Get("User-Agent"),
 		Timestamp: time.Now().Unix(),
@@ -49,17 +49,21 @@ func (h *UmamiFeeder) submitToFeed(req *http.Request, statusCode int) {
 	}
 
 	// Initialize Data map if we have captured headers or error status
-	hasData := statusCode >= 400 || len(h.captureHeaders) > 0
+	hasData := statusCode >= 400 || len(options.captureHeaders) > 0
 	if hasData {
 		event.Data = make(map[string]any)
 	}
 
 	// Capture configured headers
-	for headerName, dataKey := range h.captureHeaders {
+	for headerName, dataKey := range options.captureHeaders {
 		headerValue := req.Header.Get(headerName)
 		if headerValue != "" {
 			event.Data[dataKey] = headerValue
-			h.debugf("captured header %s=%s as %s", headerName, headerValue, dataKey)
+			if h.isSensitiveHeader(headerName) {
+				h.debugf("captured header %s=%s as %s", headerName, redacted, dataKey)
+			} else {
+				h.debugf("captured header %s=%s as %s", headerName, headerValue, dataKey)
+			}
 		}
 	}
 
@@ -68,76 +72,303 @@ func (h *UmamiFeeder) submitToFeed(req *http.Request, statusCode int) {
 		event.Data["status_code"] = statusCode
 	}
 
-	select {
-	case h.queue <- event:
-	default:
-		h.error("failed to submit event: queue full")
+	if !ok {
+		h.parkEvent(hostname, event)
+		return
 	}
+	h.backend.enqueue(event)
 }
 
-func (h *UmamiFeeder) startWorker(ctx context.Context) {
+// startWorker runs the worker until it stops, it is restarted after a panic.
+func (b *umamiBackend) startWorker(ctx context.Context, w *worker, pool *workerPool) {
 	for {
-		err := h.umamiEventFeeder(ctx)
+		err := b.umamiEventFeeder(ctx, w, pool)
 		if err != nil {
-			h.error("worker failed: " + err.Error())
+			b.error("worker failed: " + err.Error())
 		} else {
 			return
 		}
 	}
 }
 
-func (h *UmamiFeeder) umamiEventFeeder(ctx context.Context) error {
+func (b *umamiBackend) umamiEventFeeder(ctx context.Context, w *worker, pool *workerPool) (err error) {
 	defer func() {
 		// Recover from panic.
 		panicVal := recover()
 		if panicVal != nil {
-			h.error("panic: " + fmt.Sprint(panicVal))
+			err = fmt.Errorf("panic: %v", panicVal)
 		}
 	}()
 
-	batch := make([]*SendBody, 0, h.batchSize)
-	timeout := time.NewTimer(h.batchMaxWait)
+	batch := make([]*SendBody, 0, b.maxBatchEvents())
+	batchBytes := 0
+	timeout := time.NewTimer(b.batchMaxWait)
+	defer timeout.Stop()
+	lastEvent := time.Now()
 
 	for {
 		// Wait for event.
 		select {
 		case <-ctx.Done():
-			h.debugf("worker shutting down (canceled)")
-			if len(batch) > 0 {
-				h.reportEventsToUmami(ctx, batch)
-			}
+			b.debugf("worker %d shutting down (canceled)", w.id)
+			flushed, abandoned := b.shutdown(batch)
+			pool.flushed.Add(int64(flushed))
+			pool.abandoned.Add(int64(abandoned))
 			return nil
 
-		case event := <-h.queue:
-			batch = append(batch, &SendBody{Payload: event, Type: "event"})
-			if len(batch) >= h.batchSize {
-				h.reportEventsToUmami(ctx, batch)
-				batch = make([]*SendBody, 0, h.batchSize)
-				timeout.Reset(h.batchMaxWait)
+		case event := <-b.queue:
+			lastEvent = time.Now()
+			body := &SendBody{Payload: event, Type: "event"}
+			bodyBytes := body.size()
+			// Once canceled, the batch is left to the shutdown, which delivers it with a fresh context.
+			if len(batch) > 0 && !b.fitsBatch(batchBytes, bodyBytes) && ctx.Err() == nil {
+				batch, batchBytes = b.deliverWorkerBatch(ctx, batch)
+				timeout.Reset(b.batchMaxWait)
+			}
+			batch = append(batch, body)
+			batchBytes += bodyBytes
+			if len(batch) >= b.maxBatchEvents() && ctx.Err() == nil {
+				batch, batchBytes = b.deliverWorkerBatch(ctx, batch)
+				timeout.Reset(b.batchMaxWait)
 			}
 
 		case <-timeout.C:
+			if w.primary {
+				b.logDrops()
+			}
 			if len(batch) > 0 {
-				h.reportEventsToUmami(ctx, batch)
-				batch = make([]*SendBody, 0, h.batchSize)
+				batch, batchBytes = b.deliverWorkerBatch(ctx, batch)
+			} else if w.elastic && time.Since(lastEvent) >= pool.idleTimeout {
+				b.debugf("worker %d idle, scaled down to %d workers", w.id, pool.active.Load()-1)
+				return nil
+			} else if w.primary && b.spool != nil && b.spool.Pending() {
+				b.drainSpool(ctx)
+			}
+			timeout.Reset(b.batchMaxWait)
+		}
+	}
+}
+
+// deliverWorkerBatch delivers the batch of a worker and returns the batch to continue with and its size: a new one,
+// or the unsent events if the worker was canceled meanwhile, which are left to the shutdown.
+func (b *umamiBackend) deliverWorkerBatch(ctx context.Context, batch []*SendBody) ([]*SendBody, int) {
+	unsent, _ := b.deliverBatch(ctx, batch)
+
+	next := append(make([]*SendBody, 0, max(b.maxBatchEvents(), len(unsent))), unsent...)
+	batchBytes := 0
+	for _, event := range next {
+		batchBytes += event.size()
+	}
+	return next, batchBytes
+}
+
+// shutdown delivers the current batch and the events left in the queue with a fresh context bounded by
+// shutdownTimeout, as the context of the worker is already canceled. Events which could not be delivered
+// in time are spooled, or dropped if the spool is disabled. It returns the amount of flushed and abandoned events.
+func (b *umamiBackend) shutdown(batch []*SendBody) (int, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.shutdownTimeout)
+	defer cancel()
+
+	var flushed, abandoned int
+	var next *SendBody
+	for {
+		batch, next = b.fillBatch(batch, next)
+		if len(batch) == 0 {
+			break
+		}
+
+		if ctx.Err() != nil {
+			b.failBatch(batch, "shutdown timeout exceeded")
+			abandoned += len(batch)
+		} else if unsent, delivered := b.deliverBatch(ctx, batch); delivered {
+			flushed += len(batch)
+		} else if len(unsent) > 0 {
+			b.failBatch(unsent, "shutdown timeout exceeded")
+			flushed += len(batch) - len(unsent)
+			abandoned += len(unsent)
+		} else {
+			abandoned += len(batch)
+		}
+		batch = make([]*SendBody, 0, b.maxBatchEvents())
+	}
+	return flushed, abandoned
+}
+
+// fillBatch adds next and the queued events to the batch until it is full by count or size, or the queue is empty,
+// without waiting. An event which does not fit into the batch anymore is returned to start the next batch with.
+func (b *umamiBackend) fillBatch(batch []*SendBody, next *SendBody) ([]*SendBody, *SendBody) {
+	batchBytes := 0
+	for _, event := range batch {
+		batchBytes += event.size()
+	}
+
+	for len(batch) < b.maxBatchEvents() {
+		body := next
+		next = nil
+		if body == nil {
+			select {
+			case event := <-b.queue:
+				body = &SendBody{Payload: event, Type: "event"}
+			default:
+				return batch, nil
 			}
-			timeout.Reset(h.batchMaxWait)
+		}
+
+		bodyBytes := body.size()
+		if len(batch) > 0 && !b.fitsBatch(batchBytes, bodyBytes) {
+			return batch, body
+		}
+		batch = append(batch, body)
+		batchBytes += bodyBytes
+	}
+	return batch, next
+}
+
+// deliverBatch sends the batch to Umami, retrying retryable failures with a jittered exponential backoff.
+// The batch is dropped on a permanent failure, or when the retry attempts or the max age are exhausted.
+// Events which were delivered before a failure of a split batch are not sent again.
+// It reports whether the batch was delivered. If ctx is canceled before, the unsent events are returned
+// instead of being given up, so the caller can deliver them with another context, e.g. on shutdown.
+func (b *umamiBackend) deliverBatch(ctx context.Context, events []*SendBody) ([]*SendBody, bool) {
+	firstAttempt := time.Now()
+	for attempt := 0; ; attempt++ {
+		started := time.Now()
+		sent, err := b.sendBatch(ctx, events)
+		events = events[sent:]
+		if err == nil {
+			if attempt == 0 {
+				b.adaptBatchSize(sent, time.Since(started))
+			}
+			if b.spool != nil && b.spool.Pending() {
+				b.drainSpool(ctx)
+			}
+			return nil, true
+		}
+
+		if ctx.Err() != nil {
+			return events, false
+		}
+		if !isRetryableError(err) {
+			b.dropBatch(events, "permanent failure: "+err.Error())
+			return nil, false
+		}
+		if attempt >= b.retryMaxAttempts {
+			b.failBatch(events, fmt.Sprintf("retries exhausted after %d attempts: %s", attempt+1, err.Error()))
+			return nil, false
+		}
+
+		// While the circuit breakers are open, a retry would be rejected at once, so it waits for the probe.
+		delay := max(backoffDelay(attempt, b.retryInitialInterval, b.retryMaxInterval), b.probeDelay())
+		if b.retryMaxAge > 0 && time.Since(firstAttempt)+delay > b.retryMaxAge {
+			b.failBatch(events, fmt.Sprintf("max age of %v exceeded: %s", b.retryMaxAge, err.Error()))
+			return nil, false
+		}
+
+		b.debugf("failed to send tracking, retrying in %v (attempt #%d): %s", delay, attempt+1, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return events, false
 		}
 	}
 }
 
-func (h *UmamiFeeder) reportEventsToUmami(ctx context.Context, events []*SendBody) {
-	h.debugf("reporting %d events", len(events))
-	resp, err := sendRequest(ctx, h.umamiHost+"/api/batch", events, nil)
+// failBatch moves a batch which could not be delivered to the spool, or drops it if the spool is disabled.
+func (b *umamiBackend) failBatch(events []*SendBody, reason string) {
+	if b.spool == nil {
+		b.dropBatch(events, reason)
+		return
+	}
+
+	b.debugf("spooling batch of %d events (%s)", len(events), reason)
+	payloads := make([]*UmamiEvent, 0, len(events))
+	for _, event := range events {
+		payloads = append(payloads, event.Payload)
+	}
+	b.spoolEvents(payloads)
+}
+
+// spoolEvents writes events to the spool, events are counted as lost if that fails.
+func (b *umamiBackend) spoolEvents(events []*UmamiEvent) {
+	discarded, err := b.spool.Append(events)
 	if err != nil {
-		h.error("failed to send tracking: " + err.Error())
+		lostEvents := b.lostEvents.Add(int64(len(events)))
+		b.error(fmt.Sprintf("failed to spool %d events: %s, lost so far: %d events", len(events), err.Error(), lostEvents))
 		return
 	}
-	if h.isDebug {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		h.debugf("%v: %s", resp.Status, string(bodyBytes))
+	if discarded > 0 {
+		lostEvents := b.lostEvents.Add(int64(discarded))
+		b.error(fmt.Sprintf("spool size limit reached, discarded %d oldest events, lost so far: %d events", discarded, lostEvents))
 	}
-	defer func() {
-		_ = resp.Body.Close()
-	}()
+}
+
+// drainSpool sends the spooled events to Umami, it stops at the first failure and keeps the remaining events.
+// Only one worker drains the spool at a time, the others keep delivering the queue.
+func (b *umamiBackend) drainSpool(ctx context.Context) {
+	if !b.spoolDraining.CompareAndSwap(false, true) {
+		return
+	}
+	defer b.spoolDraining.Store(false)
+
+	result, err := b.spool.Drain(b.maxBatchEvents(), func(events []*UmamiEvent) (int, error) {
+		batch := make([]*SendBody, 0, len(events))
+		for _, event := range events {
+			batch = append(batch, &SendBody{Payload: event, Type: "event"})
+		}
+		sent, err := b.sendBatch(ctx, batch)
+		if err != nil && !isRetryableError(err) && ctx.Err() == nil {
+			b.dropBatch(batch[sent:], "permanent failure: "+err.Error())
+			return len(events), nil
+		}
+		// Only the delivered part of a split batch is removed, the rest stays in place to keep the order.
+		return sent, err
+	})
+
+	if result.Sent > 0 {
+		b.debugf("sent %d spooled events", result.Sent)
+	}
+	if result.Expired > 0 || result.Corrupt > 0 {
+		lostEvents := b.lostEvents.Add(int64(result.Expired + result.Corrupt))
+		b.error(fmt.Sprintf("discarded %d expired and %d unreadable spooled events, lost so far: %d events", result.Expired, result.Corrupt, lostEvents))
+	}
+	if err != nil {
+		b.debugf("failed to drain spool, will retry later: %s", err.Error())
+	}
+}
+
+// dropBatch records the loss of a batch which could not be delivered.
+func (b *umamiBackend) dropBatch(events []*SendBody, reason string) {
+	lostBatches := b.lostBatches.Add(1)
+	lostEvents := b.lostEvents.Add(int64(len(events)))
+	b.error(fmt.Sprintf("dropped batch of %d events (%s), lost so far: %d batches, %d events", len(events), reason, lostBatches, lostEvents))
+}
+
+// reportEventsToUmami sends the events to the first available endpoint, failing over to the others.
+func (b *umamiBackend) reportEventsToUmami(ctx context.Context, events []*SendBody) error {
+	return b.callEndpoints(func(ep *umamiEndpoint) error {
+		b.debugf("reporting %d events to %s", len(events), ep.url)
+		headers := b.batchHeaders()
+		resp, err := sendRequest(ctx, ep.client, ep.url+"/api/batch", events, headers)
+		if headers != nil && isUnsupportedEncoding(err) {
+			// The batch is resent once uncompressed, compression is only turned off if that is accepted.
+			gzipErr := err
+			resp, err = sendRequest(ctx, ep.client, ep.url+"/api/batch", events, nil)
+			if err == nil {
+				b.gzipEnabled.Store(false)
+				b.error("compressed batch rejected, sending batches uncompressed: " + gzipErr.Error())
+			}
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		if b.isDebug.Load() {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			b.debugf("%v: %s", resp.Status, string(bodyBytes))
+		}
+		return nil
+	})
 }
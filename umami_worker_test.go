@@ -0,0 +1,191 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	assertRetryable(t, true, errors.New("connection refused"))
+	assertRetryable(t, true, &requestError{StatusCode: http.StatusTooManyRequests})
+	assertRetryable(t, true, &requestError{StatusCode: http.StatusBadGateway})
+	assertRetryable(t, true, &requestError{StatusCode: http.StatusServiceUnavailable})
+	assertRetryable(t, false, &requestError{StatusCode: http.StatusBadRequest})
+	assertRetryable(t, false, &requestError{StatusCode: http.StatusUnauthorized})
+	assertRetryable(t, false, &requestError{StatusCode: http.StatusNotFound})
+	assertRetryable(t, false, context.Canceled)
+}
+
+func assertRetryable(t *testing.T, expected bool, err error) {
+	t.Helper()
+	if expected != isRetryableError(err) {
+		t.Fatalf("expected %v for %v", expected, err)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := range 10 {
+		delay := backoffDelay(attempt, time.Second, 10*time.Second)
+		if delay < 500*time.Millisecond || delay > 10*time.Second {
+			t.Fatalf("unexpected delay %v for attempt %d", delay, attempt)
+		}
+	}
+}
+
+func TestDeliverBatchRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if calls.Add(1) <= 2 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		endpoints:            testEndpoints(server),
+		retryMaxAttempts:     3,
+		retryInitialInterval: time.Millisecond,
+		retryMaxInterval:     10 * time.Millisecond,
+	}
+	backend.deliverBatch(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}})
+
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls.Load())
+	}
+	if backend.lostBatches.Load() != 0 {
+		t.Fatalf("expected no lost batches, got %d", backend.lostBatches.Load())
+	}
+}
+
+func TestDeliverBatchPermanentFailure(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		endpoints:            testEndpoints(server),
+		retryMaxAttempts:     3,
+		retryInitialInterval: time.Millisecond,
+		retryMaxInterval:     10 * time.Millisecond,
+	}
+	backend.deliverBatch(context.Background(), []*SendBody{{Type: "event", Payload: &UmamiEvent{}}, {Type: "event", Payload: &UmamiEvent{}}})
+
+	if calls.Load() != 1 {
+		t.Fatalf("expected 1 call, got %d", calls.Load())
+	}
+	if backend.lostBatches.Load() != 1 || backend.lostEvents.Load() != 2 {
+		t.Fatalf("expected 1 lost batch with 2 events, got %d/%d", backend.lostBatches.Load(), backend.lostEvents.Load())
+	}
+}
+
+func TestShutdownFlushesQueue(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var events []*SendBody
+		_ = json.NewDecoder(req.Body).Decode(&events)
+		received.Add(int32(len(events)))
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		queue:           make(chan *UmamiEvent, 100),
+		batchSize:       20,
+		batchMaxWait:    time.Hour,
+		workers:         2,
+		shutdownTimeout: time.Second,
+		endpoints:       testEndpoints(server),
+	}
+	for range 45 {
+		backend.queue <- &UmamiEvent{}
+	}
+
+	// The worker is stopped before it sent anything, the queued events are still delivered.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := &workerPool{}
+	backend.startWorkers(ctx, pool)
+
+	if received.Load() != 45 || pool.flushed.Load() != 45 || len(backend.queue) != 0 {
+		t.Fatalf("expected 45 delivered events, got %d (%d left)", received.Load(), len(backend.queue))
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	backend := &umamiBackend{
+		queue:                make(chan *UmamiEvent, 100),
+		batchSize:            20,
+		shutdownTimeout:      50 * time.Millisecond,
+		retryMaxAttempts:     3,
+		retryInitialInterval: time.Millisecond,
+		retryMaxInterval:     time.Millisecond,
+		endpoints:            testEndpoints(server),
+	}
+	for range 45 {
+		backend.queue <- &UmamiEvent{}
+	}
+
+	start := time.Now()
+	backend.shutdown(nil)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected shutdown to be bounded by the timeout, took %v", elapsed)
+	}
+	if backend.lostEvents.Load() != 45 {
+		t.Fatalf("expected 45 abandoned events, got %d", backend.lostEvents.Load())
+	}
+}
+
+func TestShutdownResendsBatchInFlight(t *testing.T) {
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var events []*SendBody
+		_ = json.NewDecoder(req.Body).Decode(&events)
+		select {
+		case <-time.After(200 * time.Millisecond):
+			received.Add(int32(len(events)))
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		queue:           make(chan *UmamiEvent, 100),
+		batchSize:       5,
+		batchMaxWait:    time.Hour,
+		workers:         1,
+		shutdownTimeout: time.Second,
+		endpoints:       testEndpoints(server),
+	}
+	for range 5 {
+		backend.queue <- &UmamiEvent{}
+	}
+
+	// The worker is canceled while the batch is sent, the shutdown sends it again instead of dropping it.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	pool := &workerPool{}
+	backend.startWorkers(ctx, pool)
+
+	if received.Load() != 5 || pool.flushed.Load() != 5 || backend.lostEvents.Load() != 0 {
+		t.Fatalf("expected 5 flushed events, got %d received, %d flushed, %d lost",
+			received.Load(), pool.flushed.Load(), backend.lostEvents.Load())
+	}
+}
@@ -0,0 +1,104 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// workerScaleInterval defines how often the queue depth is checked to scale the workers.
+	workerScaleInterval = time.Second
+	// workerScaleChecks defines how many consecutive checks the queue must be above the high-water mark to add a worker.
+	workerScaleChecks = 3
+	// workerIdleTimeout defines how long an added worker may be idle before it stops.
+	workerIdleTimeout = 30 * time.Second
+)
+
+// worker is a sender pulling events from the queue, with its own batch and timer.
+type worker struct {
+	id int
+	// primary is the first worker, it logs the dropped events and drains the spool.
+	primary bool
+	// elastic workers are added while the queue is deep, and stop again once idle.
+	elastic bool
+}
+
+// workerPool runs the workers of a backend.
+type workerPool struct {
+	scaleInterval time.Duration
+	idleTimeout   time.Duration
+
+	wg        sync.WaitGroup
+	active    atomic.Int32
+	nextId    int
+	flushed   atomic.Int64
+	abandoned atomic.Int64
+}
+
+// startWorkers runs the configured amount of workers until ctx is done, and adds workers up to maxWorkers
+// while the queue stays above the high-water mark. The spool is closed once all workers are stopped.
+func (b *umamiBackend) startWorkers(ctx context.Context, pool *workerPool) {
+	for i := 0; i < b.workers; i++ {
+		b.addWorker(ctx, pool, false)
+	}
+
+	if b.maxWorkers > b.workers {
+		b.scaleWorkers(ctx, pool)
+	} else {
+		<-ctx.Done()
+	}
+	pool.wg.Wait()
+
+	if b.spool != nil {
+		b.spool.Close()
+	}
+	if abandoned := pool.abandoned.Load(); abandoned > 0 {
+		b.error(fmt.Sprintf("workers stopped, flushed %d events, abandoned %d events", pool.flushed.Load(), abandoned))
+	} else {
+		b.debugf("workers stopped, flushed %d events", pool.flushed.Load())
+	}
+}
+
+func (b *umamiBackend) addWorker(ctx context.Context, pool *workerPool, elastic bool) {
+	w := &worker{id: pool.nextId, primary: pool.nextId == 0, elastic: elastic}
+	pool.nextId++
+	pool.active.Add(1)
+	pool.wg.Add(1)
+
+	go func() {
+		defer pool.wg.Done()
+		defer pool.active.Add(-1)
+		b.startWorker(ctx, w, pool)
+	}()
+}
+
+// scaleWorkers adds an elastic worker when the queue stayed above the high-water mark for workerScaleChecks checks.
+// Elastic workers stop by themselves when they are idle.
+func (b *umamiBackend) scaleWorkers(ctx context.Context, pool *workerPool) {
+	ticker := time.NewTicker(pool.scaleInterval)
+	defer ticker.Stop()
+
+	busyChecks := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if len(b.queue) < b.workersHighWater {
+				busyChecks = 0
+				continue
+			}
+
+			busyChecks++
+			if busyChecks < workerScaleChecks || int(pool.active.Load()) >= b.maxWorkers {
+				continue
+			}
+			busyChecks = 0
+			b.addWorker(ctx, pool, true)
+			b.debugf("queue holds %d events, scaled up to %d workers", len(b.queue), pool.active.Load())
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package traefik_umami_feeder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScaleWorkers(t *testing.T) {
+	var inflight, maxInflight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			current := maxInflight.Load()
+			if n <= current || maxInflight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	backend := &umamiBackend{
+		queue:            make(chan *UmamiEvent, 200),
+		batchSize:        5,
+		batchMaxWait:     10 * time.Millisecond,
+		workers:          1,
+		maxWorkers:       3,
+		workersHighWater: 20,
+		endpoints:        testEndpoints(server),
+	}
+	for range 200 {
+		backend.queue <- &UmamiEvent{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := &workerPool{scaleInterval: 10 * time.Millisecond, idleTimeout: 50 * time.Millisecond}
+	done := make(chan struct{})
+	go func() {
+		backend.startWorkers(ctx, pool)
+		close(done)
+	}()
+
+	// Workers are added while the queue is deep, and stop again once it is drained.
+	deadline := time.Now().Add(5 * time.Second)
+	for (len(backend.queue) > 0 || pool.active.Load() > 1) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if maxInflight.Load() < 2 {
+		t.Fatalf("expected concurrent batches, got at most %d", maxInflight.Load())
+	}
+	if active := pool.active.Load(); active != 1 {
+		t.Fatalf("expected to scale down to 1 worker, got %d", active)
+	}
+
+	cancel()
+	<-done
+}